@@ -0,0 +1,123 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal"
+	"sigs.k8s.io/yaml"
+)
+
+// templateRow 模板表中的一行，count为一张卡上最多可以创建的该模板的vNPU数量
+type templateRow struct {
+	Name   string `json:"name"`
+	Memory int64  `json:"memory"`
+	AICore int32  `json:"aiCore"`
+	AICPU  int32  `json:"aiCPU"`
+	Count  int64  `json:"count"`
+}
+
+type effectiveConfig struct {
+	Chip         string              `json:"chip"`
+	Overrides    []string            `json:"overrides,omitempty"`
+	VDeviceCount int                 `json:"vDeviceCount"`
+	VNPU         internal.VNPUConfig `json:"vnpu"`
+	Templates    []templateRow       `json:"templateTable"`
+}
+
+// runConfig ascend-device-plugin config show --config_file config.yaml --chip 910B3
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "show" {
+		return fmt.Errorf("usage: %s config show --config_file <file> --chip <chip name> [--node_labels k=v,...] [--output yaml|json]", os.Args[0])
+	}
+	fs := flag.NewFlagSet("config show", flag.ExitOnError)
+	file := fs.String("config_file", "", "config file path")
+	chip := fs.String("chip", "", "chip name, e.g. 910B3")
+	labels := fs.String("node_labels", "", "node labels used to match nodeOverrides, e.g. pool=inference,zone=a")
+	output := fs.String("output", "yaml", "output format, yaml or json")
+	_ = fs.Parse(args[1:])
+	if *file == "" || *chip == "" {
+		return fmt.Errorf("--config_file and --chip must be set")
+	}
+	nodeLabels, err := parseLabels(*labels)
+	if err != nil {
+		return err
+	}
+	config, err := internal.LoadConfig(*file)
+	if err != nil {
+		return err
+	}
+	vc, overrides, err := config.SelectVNPUConfig(*chip, nodeLabels)
+	if err != nil {
+		return err
+	}
+	out := effectiveConfig{
+		Chip:         *chip,
+		Overrides:    overrides,
+		VDeviceCount: vc.VDeviceCount(),
+		VNPU:         *vc,
+	}
+	for _, t := range vc.Templates {
+		out.Templates = append(out.Templates, templateRow{
+			Name:   t.Name,
+			Memory: t.Memory,
+			AICore: t.AICore,
+			AICPU:  t.AICPU,
+			Count:  vc.MemoryAllocatable / t.Memory,
+		})
+	}
+	return printOutput(out, *output)
+}
+
+func parseLabels(value string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, kv := range strings.Split(value, ",") {
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid node label %q, expected key=value", kv)
+		}
+		labels[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return labels, nil
+}
+
+func printOutput(v interface{}, format string) error {
+	var data []byte
+	var err error
+	switch format {
+	case "json":
+		data, err = json.MarshalIndent(v, "", "  ")
+		data = append(data, '\n')
+	case "yaml":
+		data, err = yaml.Marshal(v)
+	default:
+		return fmt.Errorf("unknown output format %s", format)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
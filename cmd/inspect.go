@@ -0,0 +1,160 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/logging"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/manager"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/server"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+type inspectDevice struct {
+	LogicID    int32  `json:"logicID"`
+	PhyID      int32  `json:"phyID"`
+	CardID     int32  `json:"cardID"`
+	DeviceID   int32  `json:"deviceID"`
+	UUID       string `json:"uuid"`
+	HealthCode uint32 `json:"healthCode"`
+	Memory     int64  `json:"memory"`
+	AICore     int32  `json:"aiCore"`
+	PCIeBusID  string `json:"pcieBusID,omitempty"`
+	NUMA       int    `json:"numa"`
+	VNPUs      int    `json:"vnpus"`
+}
+
+type inspectOutput struct {
+	Chip               string              `json:"chip"`
+	Devices            []inspectDevice     `json:"devices"`
+	RegisterAnnotation map[string]string   `json:"registerAnnotation"`
+	ResourceName       string              `json:"resourceName"`
+	KubeletDevices     []*v1beta1.Device   `json:"kubeletDevices"`
+	VNPUConfig         internal.VNPUConfig `json:"vnpuConfig"`
+}
+
+// runInspect ascend-device-plugin inspect --config_file config.yaml，打印驱动发现的设备以及插件将要上报的内容，不会注册任何东西
+func runInspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	file := fs.String("config_file", "", "config file path")
+	labels := fs.String("node_labels", "", "node labels used to match nodeOverrides, e.g. pool=inference,zone=a")
+	output := fs.String("output", "table", "output format, table, yaml or json")
+	hwLevel := fs.Int("hw_loglevel", 2, "huawei log level, -1-debug, 0-info, 1-warning, 2-error 3-critical")
+	_ = fs.Parse(args)
+	if *file == "" {
+		return fmt.Errorf("usage: %s inspect --config_file <file> [--node_labels k=v,...] [--output table|yaml|json]", os.Args[0])
+	}
+	nodeLabels, err := parseLabels(*labels)
+	if err != nil {
+		return err
+	}
+	// hwlog的日志写到标准错误，避免混入表格和json输出
+	sink, err := logging.NewHWLogSink(logging.WriterHandler(os.Stderr))
+	if err != nil {
+		return fmt.Errorf("create huawei run logger sink failed: %v", err)
+	}
+	defer sink.Close()
+	out, err := inspectNode(*file, nodeLabels, *hwLevel, sink)
+	if err != nil {
+		return err
+	}
+	if *output != "table" {
+		return printOutput(out, *output)
+	}
+	printInspectTable(out)
+	return nil
+}
+
+// inspectNode 通过驱动发现设备，生成插件将要上报的注解和设备列表
+func inspectNode(file string, nodeLabels map[string]string, hwLevel int, sink *logging.HWLogSink) (*inspectOutput, error) {
+	if err := initHWLog(hwLevel, sink); err != nil {
+		return nil, fmt.Errorf("init huawei run logger failed: %v", err)
+	}
+	mgr, err := manager.NewAscendManager()
+	if err != nil {
+		return nil, fmt.Errorf("init AscendManager failed: %v", err)
+	}
+	if err := mgr.LoadConfig(file, nodeLabels); err != nil {
+		return nil, fmt.Errorf("load config failed: %v", err)
+	}
+	if err := mgr.UpdateDevice(); err != nil {
+		return nil, fmt.Errorf("update device failed: %v", err)
+	}
+	// 只用来生成注解和设备列表，不会启动也不会注册
+	ps, err := server.NewPluginServer(mgr, nil, "", mgr.RuntimeConfig(), true)
+	if err != nil {
+		return nil, err
+	}
+	vc, _ := mgr.VNPUConfig()
+	out := inspectOutput{
+		Chip:           vc.ChipName,
+		ResourceName:   mgr.ResourceName(),
+		KubeletDevices: ps.KubeletDevices(),
+		VNPUConfig:     vc,
+	}
+	for _, dev := range mgr.GetDevices() {
+		busID, numa, err := mgr.PCIeInfo(dev.LogicID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "get pcie info of device %d failed: %v\n", dev.LogicID, err)
+		}
+		out.Devices = append(out.Devices, inspectDevice{
+			LogicID:    dev.LogicID,
+			PhyID:      dev.PhyID,
+			CardID:     dev.CardID,
+			DeviceID:   dev.DeviceID,
+			UUID:       dev.UUID,
+			HealthCode: dev.HealthCode,
+			Memory:     dev.Memory,
+			AICore:     dev.AICore,
+			PCIeBusID:  busID,
+			NUMA:       numa,
+			VNPUs:      len(dev.VNPUs),
+		})
+	}
+	key, value, err := ps.RegisterAnnotation()
+	if err != nil {
+		return nil, err
+	}
+	out.RegisterAnnotation = map[string]string{key: value}
+	return &out, nil
+}
+
+func printInspectTable(out *inspectOutput) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LOGIC\tPHY\tCARD\tDEVICE\tUUID\tHEALTH\tMEMORY\tAICORE\tNUMA\tPCIE\tVNPUS")
+	for _, d := range out.Devices {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%s\t%d\t%d\t%d\t%d\t%s\t%d\n", d.LogicID, d.PhyID, d.CardID, d.DeviceID,
+			d.UUID, d.HealthCode, d.Memory, d.AICore, d.NUMA, d.PCIeBusID, d.VNPUs)
+	}
+	_ = w.Flush()
+	// 节点注解中停用的卡需要访问API Server，这里只包含配置文件中停用的卡
+	fmt.Println("\nregister annotation:")
+	for key, value := range out.RegisterAnnotation {
+		fmt.Printf("%s: %s\n", key, value)
+	}
+	fmt.Printf("\nkubelet devices (%s, %d):\n", out.ResourceName, len(out.KubeletDevices))
+	fmt.Fprintln(w, "ID\tHEALTH")
+	for _, d := range out.KubeletDevices {
+		fmt.Fprintf(w, "%s\t%s\n", d.ID, d.Health)
+	}
+	_ = w.Flush()
+}
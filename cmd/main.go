@@ -21,14 +21,23 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"reflect"
 	"syscall"
+	"time"
 
 	"github.com/Project-HAMi/ascend-device-plugin/internal"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/audit"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/hami"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/logging"
 	"github.com/Project-HAMi/ascend-device-plugin/internal/manager"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/metrics"
 	"github.com/Project-HAMi/ascend-device-plugin/internal/server"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/tracing"
 	"github.com/Project-HAMi/ascend-device-plugin/version"
 	"github.com/fsnotify/fsnotify"
 	"huawei.com/npu-exporter/v6/common-utils/hwlog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
@@ -176,21 +185,142 @@ metadata:
 */
 
 var (
-	hwLoglevel = flag.Int("hw_loglevel", 0, "huawei log level, -1-debug, 0-info, 1-warning, 2-error 3-critical default value: 0")
-	configFile = flag.String("config_file", "", "config file path")
-	nodeName   = flag.String("node_name", os.Getenv("NODE_NAME"), "node name")
+	hwLoglevel  = flag.Int("hw_loglevel", 0, "deprecated, huawei log level is derived from -v, -1-debug, 0-info, 1-warning, 2-error 3-critical")
+	logFormat   = flag.String("log_format", logging.FormatText, "log format, text or json")
+	configFile  = flag.String("config_file", "", "config file path")
+	configMap   = flag.String("config_configmap", "", "load config from configmap namespace/name[:key] through the API and apply changes at runtime, instead of config_file")
+	nodeName    = flag.String("node_name", os.Getenv("NODE_NAME"), "node name")
+	debugAddr   = flag.String("debug_addr", "", "debug http server listen address, must be a loopback address, e.g. 127.0.0.1:9099, empty to disable")
+	metricsAddr = flag.String("metrics_addr", "", "prometheus metrics listen address, e.g. :9100, empty to disable")
+	auditLog    = flag.String("audit_log", "/var/log/mindx-dl/devicePlugin/allocation-audit.log", "file to write one JSON record per Allocate call, empty to disable")
+	auditMaxMB  = flag.Int("audit_log_max_size", 20, "max size in MB of the audit log before it is rotated")
+	auditKeep   = flag.Int("audit_log_max_backups", 10, "number of rotated audit log files to keep")
+	dryRun      = flag.Bool("dry-run", false, "run device and health loops without registering to kubelet, patching the node or releasing node locks, only log what would be done")
+
+	traceExporter     = flag.String("trace_exporter", tracing.ExporterNone, "opentelemetry trace exporter, none, otlp or file")
+	traceOTLPEndpoint = flag.String("trace_otlp_endpoint", "", "otlp grpc endpoint host:port, empty to use OTEL_EXPORTER_OTLP_ENDPOINT or the default localhost:4317")
+	traceOTLPInsecure = flag.Bool("trace_otlp_insecure", false, "disable TLS of the otlp grpc connection")
+	traceFile         = flag.String("trace_file", "/var/log/mindx-dl/devicePlugin/traces.json", "file to write one JSON span per line when trace_exporter is file")
+	traceSampleRatio  = flag.Float64("trace_sample_ratio", 1, "fraction of traces to sample, between 0 and 1")
+
+	// 以下参数会覆盖配置文件中runtime部分的配置
+	healthCheckInterval = flag.Duration("health_check_interval", internal.DefaultHealthCheckInterval, "interval of device health check")
+	registerInterval    = flag.Duration("register_interval", internal.DefaultRegisterInterval, "interval of checking whether devices need to be registered to node annotations")
+	handshakeInterval   = flag.Duration("handshake_interval", internal.DefaultHandshakeInterval, "interval of refreshing the handshake annotation")
+	outOfServicePeriod  = flag.Duration("out_of_service_period", internal.DefaultOutOfServicePeriod, "time devices stay out of service after the scheduler removed them before being reported again")
+	errorBackoff        = flag.Duration("error_backoff", internal.DefaultErrorBackoff, "retry interval after registering failed")
+	errorBackoffJitter  = flag.Float64("error_backoff_jitter", internal.DefaultErrorBackoffJitter, "max jitter factor added to error_backoff")
+	dialTimeout         = flag.Duration("dial_timeout", internal.DefaultDialTimeout, "timeout of dialing device plugin and kubelet socket")
+	reportTimeOffset    = flag.Int64("report_time_offset", 1, "report time offset")
+	telemetryInterval   = flag.Duration("telemetry_interval", internal.DefaultTelemetryInterval, "interval of collecting device temperature, power, utilization, hbm and ecc metrics, only used when metrics_addr is set")
+	shutdownGracePeriod = flag.Duration("shutdown_grace_period", internal.DefaultShutdownGracePeriod, "time to wait for in-flight Allocate calls on shutdown before aborting them")
+	unregisterOnExit    = flag.Bool("unregister_on_shutdown", false, "mark all registered devices unhealthy in the node annotation when shutting down")
+	taintUnhealthyNode  = flag.Bool("taint_unhealthy_node", false, "taint the node when the number of unhealthy devices reaches taint_threshold")
+	taintThreshold      = flag.Int("taint_threshold", internal.DefaultTaintThreshold, "number of unhealthy devices to taint the node")
 )
 
 func checkFlags() {
 	version.CheckVersionFlag()
-	if *configFile == "" {
-		klog.Fatalf("config file not set, use --config_file to set config file path")
+	if (*configFile == "") == (*configMap == "") {
+		klog.Fatalf("exactly one of --config_file and --config_configmap must be set")
 	}
 	if *nodeName == "" {
 		klog.Fatalf("node name not set, use --node_name or env NODE_NAME to set node name")
 	}
 }
 
+// runtimeConfig 以配置文件中的runtime配置为基础，使用命令行中显式指定的参数覆盖
+func runtimeConfig(rc internal.RuntimeConfig) (internal.RuntimeConfig, error) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "health_check_interval":
+			rc.HealthCheckInterval.Duration = *healthCheckInterval
+		case "register_interval":
+			rc.RegisterInterval.Duration = *registerInterval
+		case "handshake_interval":
+			rc.HandshakeInterval.Duration = *handshakeInterval
+		case "out_of_service_period":
+			rc.OutOfServicePeriod.Duration = *outOfServicePeriod
+		case "error_backoff":
+			rc.ErrorBackoff.Duration = *errorBackoff
+		case "error_backoff_jitter":
+			rc.ErrorBackoffJitter = errorBackoffJitter
+		case "dial_timeout":
+			rc.DialTimeout.Duration = *dialTimeout
+		case "report_time_offset":
+			rc.ReportTimeOffset = &metav1.Duration{Duration: time.Duration(*reportTimeOffset) * time.Second}
+		case "telemetry_interval":
+			rc.TelemetryInterval.Duration = *telemetryInterval
+		case "shutdown_grace_period":
+			rc.ShutdownGracePeriod.Duration = *shutdownGracePeriod
+		case "unregister_on_shutdown":
+			rc.UnregisterOnShutdown = *unregisterOnExit
+		case "taint_unhealthy_node":
+			rc.Taint.Enabled = *taintUnhealthyNode
+		case "taint_threshold":
+			rc.Taint.Threshold = *taintThreshold
+		}
+	})
+	if err := rc.Validate(); err != nil {
+		return rc, fmt.Errorf("invalid runtime config: %w", err)
+	}
+	rc.SetDefaults()
+	return rc, nil
+}
+
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// hwlog写日志文件时的切分配置。日志文件是HWLogSink的命名管道，这里只需要满足hwlog对配置的校验
+const (
+	hwlogFileMaxSize = 20
+	hwlogMaxBackups  = 1
+	hwlogMaxAge      = 7
+)
+
+// initHWLog 初始化昇腾驱动接口使用的日志，日志写到sink的命名管道中，由sink转发
+func initHWLog(level int, sink *logging.HWLogSink) error {
+	config := &hwlog.LogConfig{
+		LogFileName: sink.Path(),
+		OnlyToFile:  true,
+		LogLevel:    level,
+		FileMaxSize: hwlogFileMaxSize,
+		MaxBackups:  hwlogMaxBackups,
+		MaxAge:      hwlogMaxAge,
+	}
+	return hwlog.InitRunLogger(config, context.Background())
+}
+
+// reloadConfig 应用ConfigMap中更新的配置。节点标签重新获取失败时使用启动时的标签，runtime配置（包括抖动检测）仍然使用启动时的值
+func reloadConfig(client kubernetes.Interface, mgr *manager.AscendManager, ps *server.PluginServer, config *internal.Config, labels map[string]string, started internal.RuntimeConfig) {
+	if node, err := client.CoreV1().Nodes().Get(context.Background(), *nodeName, metav1.GetOptions{}); err == nil {
+		labels = node.Labels
+	} else {
+		klog.Warningf("get node %s failed, use labels at startup: %v", *nodeName, err)
+	}
+	if err := mgr.ApplyConfig(config, labels); err != nil {
+		klog.Errorf("apply config from configmap %s failed, keep using the current config: %v", *configMap, err)
+		return
+	}
+	rc, err := runtimeConfig(mgr.RuntimeConfig())
+	if err != nil {
+		klog.Errorf("%v, keep using the current runtime config", err)
+		rc = started
+	}
+	if !reflect.DeepEqual(rc, started) {
+		klog.Warningf("runtime config changed to %+v, intervals, taint and flap settings take effect after restarting the plugin", rc)
+	}
+	klog.Infof("config reloaded from configmap %s", *configMap)
+	ps.ConfigChanged()
+}
+
 func start(ps *server.PluginServer) error {
 	klog.Info("Starting FS watcher.")
 	// 监听/var/lib/kubelet/device-plugins目录，当kubelet重启时，会重新创建该目录
@@ -245,43 +375,147 @@ restart:
 		}
 	}
 exit:
-	err = ps.Stop()
+	err = ps.Shutdown()
 	if err != nil {
-		klog.Errorf("Failed to stop plugin server: %v", err)
+		klog.Errorf("Failed to shut down plugin server: %v", err)
 		return err
 	}
 	return nil
 }
 
+// subcommands 除了插件本身之外的子命令，都不需要访问集群
+var subcommands = map[string]func(args []string) error{
+	"config":   runConfig,
+	"simulate": runSimulate,
+	"inspect":  runInspect,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
 	klog.InitFlags(nil)
 	flag.Parse()
 	checkFlags()
+	if err := logging.Setup(*logFormat, *nodeName); err != nil {
+		klog.Fatalf("%v", err)
+	}
 	klog.Infof("version: %s", version.GetVersion())
-	// TODO 这里最好把这个配置文件打印出来，方便定位问题
-	klog.Infof("using config file: %s", *configFile)
-	config := &hwlog.LogConfig{
-		OnlyToStdout: true,
-		LogLevel:     *hwLoglevel,
+	// 生效的配置可以通过 ascend-device-plugin config show 查看
+	if *configMap != "" {
+		klog.Infof("using config configmap: %s", *configMap)
+	} else {
+		klog.Infof("using config file: %s", *configFile)
 	}
-	err := hwlog.InitRunLogger(config, context.Background())
+	// hwlog的日志通过klog输出，日志级别跟随-v
+	hwlogSink, err := logging.NewHWLogSink(logging.KlogHandler())
+	if err != nil {
+		klog.Fatalf("create huawei run logger sink failed, %v", err)
+	}
+	defer hwlogSink.Close()
+	hwLevel := logging.HWLogLevel()
+	if isFlagSet("hw_loglevel") {
+		klog.Warning("--hw_loglevel is deprecated, use -v instead")
+		hwLevel = *hwLoglevel
+	}
+	err = initHWLog(hwLevel, hwlogSink)
 	if err != nil {
 		klog.Fatalf("init huawei run logger failed, %v", err)
 	}
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter:     *traceExporter,
+		OTLPEndpoint: *traceOTLPEndpoint,
+		OTLPInsecure: *traceOTLPInsecure,
+		File:         *traceFile,
+		SampleRatio:  *traceSampleRatio,
+		NodeName:     *nodeName,
+	})
+	if err != nil {
+		klog.Fatalf("init tracing failed, %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			klog.Errorf("flush traces failed: %v", err)
+		}
+	}()
+	client, err := hami.Client()
+	if err != nil {
+		klog.Fatalf("create kubernetes client failed, error is %v", err)
+	}
 	// 这里的AscendManager本质上其实就是昇腾DeviceManager的封装, 拥有DCMI接口，因此可以调用底层驱动获取芯片信息
 	mgr, err := manager.NewAscendManager()
 	if err != nil {
 		klog.Fatalf("init AscendManager failed, error is %v", err)
 	}
 	// 通过驱动获取当前节点芯片的配置信息，通过芯片的名字找到当前芯片的配置，并对当前芯片的虚拟化模板按照从小到大的顺序排序
-	err = mgr.LoadConfig(*configFile)
+	// 节点标签用于匹配配置文件中的nodeOverrides
+	node, err := client.CoreV1().Nodes().Get(context.Background(), *nodeName, metav1.GetOptions{})
+	if err != nil {
+		klog.Fatalf("get node %s failed, error is %v", *nodeName, err)
+	}
+	var cmRef internal.ConfigMapRef
+	var cmVersion string
+	if *configMap != "" {
+		cmRef, err = internal.ParseConfigMapRef(*configMap)
+		if err != nil {
+			klog.Fatalf("%v", err)
+		}
+		var config *internal.Config
+		config, cmVersion, err = internal.LoadConfigMap(context.Background(), client, cmRef)
+		if err == nil {
+			err = mgr.ApplyConfig(config, node.Labels)
+		}
+	} else {
+		err = mgr.LoadConfig(*configFile, node.Labels)
+	}
 	if err != nil {
 		klog.Fatalf("load config failed, error is %v", err)
 	}
-	server, err := server.NewPluginServer(mgr, *nodeName)
+	rc, err := runtimeConfig(mgr.RuntimeConfig())
+	if err != nil {
+		klog.Fatalf("%v", err)
+	}
+	klog.Infof("runtime config: %+v", rc)
+	mgr.SetFlapConfig(rc.Flap)
+	if *dryRun {
+		klog.Warning("dry run mode, nothing will be registered or written to the node")
+	}
+	server, err := server.NewPluginServer(mgr, client, *nodeName, rc, *dryRun)
 	if err != nil {
 		klog.Fatalf("init PluginServer failed, error is %v", err)
 	}
+	if *auditLog != "" {
+		auditLogger, err := audit.NewLogger(*auditLog, *auditMaxMB, *auditKeep)
+		if err != nil {
+			klog.Errorf("open audit log %s failed, allocations will not be audited: %v", *auditLog, err)
+		} else {
+			defer auditLogger.Close()
+			server.SetAuditLogger(auditLogger)
+		}
+	}
+	if *metricsAddr != "" {
+		server.EnableTelemetry()
+	}
+	if *configMap != "" {
+		stopCh := make(chan struct{})
+		defer close(stopCh)
+		err = internal.WatchConfigMap(client, cmRef, cmVersion, stopCh, func(config *internal.Config) {
+			reloadConfig(client, mgr, server, config, node.Labels, rc)
+		})
+		if err != nil {
+			klog.Fatalf("watch configmap %s failed, error is %v", cmRef, err)
+		}
+	}
+	go server.ServeDebug(*debugAddr)
+	go metrics.Serve(*metricsAddr)
 
 	err = start(server)
 	if err != nil {
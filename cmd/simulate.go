@@ -0,0 +1,93 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/simulator"
+	"sigs.k8s.io/yaml"
+)
+
+// runSimulate ascend-device-plugin simulate --config_file config.yaml --scenario scenario.yaml
+func runSimulate(args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	file := fs.String("config_file", "", "config file path")
+	scenarioFile := fs.String("scenario", "", "scenario file with the node description and pod requests, see internal/simulator")
+	policy := fs.String("policy", simulator.PolicySpread, "device scheduling policy, spread or binpack")
+	output := fs.String("output", "table", "output format, table, yaml or json")
+	_ = fs.Parse(args)
+	if *file == "" || *scenarioFile == "" {
+		return fmt.Errorf("usage: %s simulate --config_file <file> --scenario <file> [--policy spread|binpack] [--output table|yaml|json]", os.Args[0])
+	}
+	data, err := os.ReadFile(*scenarioFile)
+	if err != nil {
+		return err
+	}
+	var scenario simulator.Scenario
+	if err := yaml.UnmarshalStrict(data, &scenario); err != nil {
+		return fmt.Errorf("scenario file %s: %w", *scenarioFile, err)
+	}
+	config, err := internal.LoadConfig(*file)
+	if err != nil {
+		return err
+	}
+	vc, _, err := config.SelectVNPUConfig(scenario.Chip, scenario.NodeLabels)
+	if err != nil {
+		return err
+	}
+	result, err := simulator.Run(vc, &scenario, *policy)
+	if err != nil {
+		return err
+	}
+	if *output != "table" {
+		return printOutput(result, *output)
+	}
+	printSimulateTable(result)
+	return nil
+}
+
+func printSimulateTable(result *simulator.Result) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REQUEST\tCOUNT\tMEMORY\tTEMPLATE\tGRANTED\tCARDS\tREJECTED")
+	for _, a := range result.Allocations {
+		template := a.Template
+		if template == "" && a.Reason == "" {
+			template = "<whole card>"
+		}
+		cards := make([]string, 0, len(a.Cards))
+		for _, c := range a.Cards {
+			cards = append(cards, fmt.Sprint(c))
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%d\t%s\t%s\n",
+			a.Request, a.Count, a.Memory, template, a.Granted, strings.Join(cards, ","), a.Reason)
+	}
+	_ = w.Flush()
+	fmt.Println()
+	fmt.Fprintln(w, "CARD\tHEALTHY\tVNPUS\tMEMORY\tAICORE\tLEFTOVER MEMORY\tLEFTOVER VNPUS")
+	for _, c := range result.Cards {
+		fmt.Fprintf(w, "%d\t%t\t%d/%d\t%d/%d\t%d/%d\t%d\t%d\n", c.Index, c.Healthy, c.VNPUs, c.MaxVNPUs,
+			c.UsedMemory, c.Memory, c.UsedAICore, c.AICore, c.LeftoverMemory, c.LeftoverVNPUs)
+	}
+	_ = w.Flush()
+	fmt.Printf("\nplaced %d, rejected %d\n", result.Placed, result.Rejected)
+}
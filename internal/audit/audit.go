@@ -0,0 +1,144 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package audit 把每一次Allocate的结果以一行JSON的形式写入按大小滚动的文件，用于计费以及事后追溯谁用了哪一块NPU
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal/hami"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+type PodRef struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	UID       string `json:"uid"`
+}
+
+// Record 一次Allocate调用的结果
+type Record struct {
+	Time time.Time `json:"time"`
+	Node string    `json:"node"`
+	Pod  *PodRef   `json:"pod,omitempty"`
+	// kubelet选择的设备ID
+	DeviceIDs []string `json:"deviceIDs"`
+	// 调度器写入Pod注解中的设备和模板
+	RuntimeInfo []hami.RuntimeInfo `json:"runtimeInfo,omitempty"`
+	PhyIDs      []int32            `json:"phyIDs,omitempty"`
+	Template    string             `json:"template,omitempty"`
+	Envs        map[string]string  `json:"envs,omitempty"`
+	DurationMs  float64            `json:"durationMs"`
+	Outcome     string             `json:"outcome"`
+	Error       string             `json:"error,omitempty"`
+}
+
+// Logger 线程安全，文件超过maxSize之后滚动，最多保留maxBackups个历史文件：audit.log.1为最新的历史文件
+type Logger struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewLogger 打开审计日志文件，文件所在的目录必须已经存在
+func NewLogger(path string, maxSizeMB, maxBackups int) (*Logger, error) {
+	if maxSizeMB <= 0 {
+		return nil, fmt.Errorf("max size of audit log must be positive")
+	}
+	l := &Logger{
+		path:       path,
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Logger) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// Write 写入一条记录，写入之后超过大小限制时在写入下一条之前滚动
+func (l *Logger) Write(r *Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size > 0 && l.size+int64(len(data)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("rotate audit log %s: %v", l.path, err)
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	return err
+}
+
+func (l *Logger) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	_ = os.Remove(backupName(l.path, l.maxBackups))
+	for i := l.maxBackups - 1; i >= 1; i-- {
+		_ = os.Rename(backupName(l.path, i), backupName(l.path, i+1))
+	}
+	if l.maxBackups > 0 {
+		if err := os.Rename(l.path, backupName(l.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Truncate(l.path, 0); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func backupName(path string, i int) string {
+	return filepath.Join(filepath.Dir(path), fmt.Sprintf("%s.%d", filepath.Base(path), i))
+}
+
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// ConfigMapRef 通过--config_configmap指定的ConfigMap，格式为namespace/name[:key]，不指定key时按照ParseConfigMapData的规则查找
+type ConfigMapRef struct {
+	Namespace string
+	Name      string
+	Key       string
+}
+
+func (r ConfigMapRef) String() string {
+	s := r.Namespace + "/" + r.Name
+	if r.Key != "" {
+		s += ":" + r.Key
+	}
+	return s
+}
+
+// ParseConfigMapRef 解析namespace/name[:key]
+func ParseConfigMapRef(value string) (ConfigMapRef, error) {
+	var ref ConfigMapRef
+	nsName, key, _ := strings.Cut(value, ":")
+	ns, name, ok := strings.Cut(nsName, "/")
+	if !ok || ns == "" || name == "" || strings.Contains(name, "/") {
+		return ref, fmt.Errorf("invalid configmap %q, expected namespace/name[:key]", value)
+	}
+	ref.Namespace, ref.Name, ref.Key = ns, name, key
+	return ref, nil
+}
+
+// ConfigFromConfigMap 从ConfigMap中解析配置
+func ConfigFromConfigMap(cm *v1.ConfigMap, key string) (*Config, error) {
+	if key == "" {
+		return ParseConfigMapData(cm.Data)
+	}
+	value, ok := cm.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("ConfigMap %s/%s has no key %s", cm.Namespace, cm.Name, key)
+	}
+	return parseConfigMapKey(key, value)
+}
+
+// LoadConfigMap 通过API读取ConfigMap中的配置，同时返回ConfigMap的resourceVersion
+func LoadConfigMap(ctx context.Context, client kubernetes.Interface, ref ConfigMapRef) (*Config, string, error) {
+	cm, err := client.CoreV1().ConfigMaps(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, "", err
+	}
+	config, err := ConfigFromConfigMap(cm, ref.Key)
+	if err != nil {
+		return nil, "", err
+	}
+	return config, cm.ResourceVersion, nil
+}
+
+// WatchConfigMap 监听ConfigMap的变化，resourceVersion之后每次内容变化并且解析成功之后调用onChange。
+// ConfigMap被删除或者内容不合法时只打印日志，继续使用之前的配置
+func WatchConfigMap(client kubernetes.Interface, ref ConfigMapRef, resourceVersion string, stopCh <-chan struct{}, onChange func(*Config)) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(ref.Namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", ref.Name).String()
+		}))
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	lastVersion := resourceVersion
+	handle := func(obj interface{}) {
+		cm, ok := obj.(*v1.ConfigMap)
+		if !ok || cm.ResourceVersion == lastVersion {
+			return
+		}
+		lastVersion = cm.ResourceVersion
+		config, err := ConfigFromConfigMap(cm, ref.Key)
+		if err != nil {
+			klog.Errorf("ignore invalid config in configmap %s: %v", ref, err)
+			return
+		}
+		onChange(config)
+	}
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: handle,
+		UpdateFunc: func(_, newObj interface{}) {
+			handle(newObj)
+		},
+		DeleteFunc: func(interface{}) {
+			klog.Warningf("configmap %s deleted, keep using the current config", ref)
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("add configmap event handler error: %v", err)
+	}
+	factory.Start(stopCh)
+	return nil
+}
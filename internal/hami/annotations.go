@@ -0,0 +1,145 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hami
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// 调度器写入Pod的注解，与HAMi的pkg/util保持一致
+const (
+	AssignedNodeAnnotations = "hami.io/vgpu-node"
+	BindTimeAnnotations     = "hami.io/bind-time"
+	DeviceBindPhase         = "hami.io/bind-phase"
+
+	DeviceBindAllocating = "allocating"
+	DeviceBindSuccess    = "success"
+
+	// OneContainerMultiDeviceSplitSymbol 一个容器的多张卡之间的分隔符
+	OneContainerMultiDeviceSplitSymbol = ":"
+	// OnePodMultiContainerSplitSymbol 一个Pod的多个容器之间的分隔符
+	OnePodMultiContainerSplitSymbol = ";"
+)
+
+// DeviceInfo 注册到节点注解中的一张卡，字段与HAMi的util.DeviceInfo相同
+type DeviceInfo struct {
+	ID      string `json:"id,omitempty"`
+	Index   uint   `json:"index,omitempty"`
+	Count   int32  `json:"count,omitempty"`
+	Devmem  int32  `json:"devmem,omitempty"`
+	Devcore int32  `json:"devcore,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Numa    int    `json:"numa,omitempty"`
+	Health  bool   `json:"health,omitempty"`
+}
+
+// RuntimeInfo 调度器在huawei.com/<commonWord>注解中为Pod选择的卡以及模板，与HAMi的ascend.RuntimeInfo相同
+type RuntimeInfo struct {
+	UUID string `json:"UUID,omitempty"`
+	Temp string `json:"temp,omitempty"`
+}
+
+// ContainerDevice hami.io/<commonWord>-devices-allocated注解中一个容器使用的一张卡
+type ContainerDevice struct {
+	UUID      string
+	Type      string
+	Usedmem   int32
+	Usedcores int32
+}
+
+// DecodeContainerDevices 解析一个容器的设备，格式为uuid,type,mem,cores:uuid,type,mem,cores:
+func DecodeContainerDevices(str string) ([]ContainerDevice, error) {
+	var devs []ContainerDevice
+	for _, val := range strings.Split(str, OneContainerMultiDeviceSplitSymbol) {
+		if !strings.Contains(val, ",") {
+			continue
+		}
+		fields := strings.Split(val, ",")
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("invalid container device %q", val)
+		}
+		mem, _ := strconv.ParseInt(fields[2], 10, 32)
+		cores, _ := strconv.ParseInt(fields[3], 10, 32)
+		devs = append(devs, ContainerDevice{UUID: fields[0], Type: fields[1], Usedmem: int32(mem), Usedcores: int32(cores)})
+	}
+	return devs, nil
+}
+
+// IsAllocatingPod 调度器已经把Pod绑定到节点上，正在等待插件分配设备
+func IsAllocatingPod(pod *v1.Pod, nodeName string) bool {
+	if pod.Status.Phase != v1.PodPending {
+		return false
+	}
+	if _, ok := pod.Annotations[BindTimeAnnotations]; !ok {
+		return false
+	}
+	if pod.Annotations[DeviceBindPhase] != DeviceBindAllocating {
+		return false
+	}
+	return pod.Annotations[AssignedNodeAnnotations] == nodeName
+}
+
+// GetPendingPod 从API Server查找当前节点上需要分配设备的Pod，优先使用节点锁中记录的Pod，逻辑与HAMi的util.GetPendingPod相同
+func GetPendingPod(ctx context.Context, client kubernetes.Interface, nodeName string) (*v1.Pod, error) {
+	node, err := client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if value, ok := node.Annotations[NodeLockKey]; ok {
+		_, ns, name, err := ParseNodeLock(value)
+		if err != nil {
+			return nil, err
+		}
+		if ns != "" && name != "" {
+			return client.CoreV1().Pods(ns).Get(ctx, name, metav1.GetOptions{})
+		}
+	}
+	pods, err := client.CoreV1().Pods("").List(ctx, metav1.ListOptions{FieldSelector: "spec.nodeName=" + nodeName})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		if IsAllocatingPod(&pods.Items[i], nodeName) {
+			return &pods.Items[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no binding pod found on node %s", nodeName)
+}
+
+// PatchNodeAnnotations 通过strategic merge patch更新节点的注解
+func PatchNodeAnnotations(ctx context.Context, client kubernetes.Interface, nodeName string, annotations map[string]string) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = client.CoreV1().Nodes().Patch(ctx, nodeName, types.StrategicMergePatchType, data, metav1.PatchOptions{})
+	return err
+}
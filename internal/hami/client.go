@@ -0,0 +1,62 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package hami 插件与HAMi调度器之间约定的注解和节点锁，以及访问API Server的客户端。
+//
+// HAMi的pkg/util等包都依赖pkg/util/client，后者在init中创建客户端，没有kubeconfig时直接panic，
+// 因此插件不再导入这些包，离线子命令和单元测试都不需要集群。这里的常量和格式需要与HAMi调度器保持一致
+package hami
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+)
+
+var (
+	clientOnce sync.Once
+	kubeClient kubernetes.Interface
+	clientErr  error
+)
+
+// Client 第一次调用时创建客户端，查找配置的顺序与HAMi相同：KUBECONFIG、~/.kube/config、集群内的ServiceAccount
+func Client() (kubernetes.Interface, error) {
+	clientOnce.Do(func() {
+		kubeClient, clientErr = newClient()
+	})
+	return kubeClient, clientErr
+}
+
+func newClient() (kubernetes.Interface, error) {
+	kubeConfig := os.Getenv("KUBECONFIG")
+	if kubeConfig == "" {
+		kubeConfig = filepath.Join(os.Getenv("HOME"), ".kube", "config")
+	}
+	config, err := clientcmd.BuildConfigFromFlags("", kubeConfig)
+	if err != nil {
+		klog.V(4).Infof("build config from %s failed: %v, using in-cluster config", kubeConfig, err)
+		config, err = rest.InClusterConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return kubernetes.NewForConfig(config)
+}
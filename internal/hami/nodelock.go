@@ -0,0 +1,94 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hami
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// 调度器在节点上加锁之后再绑定Pod，插件分配完成（或者失败）之后释放，例如
+// hami.io/mutex.lock: 2025-07-10T07:48:33Z,default,infer-0
+const (
+	NodeLockKey = "hami.io/mutex.lock"
+	nodeLockSep = ","
+	// maxLockRetry 更新节点冲突时的重试次数
+	maxLockRetry = 5
+)
+
+var lockMu sync.Mutex
+
+// ParseNodeLock 解析节点锁，只有时间的旧格式返回空的namespace和name
+func ParseNodeLock(value string) (lockTime time.Time, ns, name string, err error) {
+	s := strings.Split(value, nodeLockSep)
+	if len(s) != 3 {
+		lockTime, err = time.Parse(time.RFC3339, value)
+		return lockTime, "", "", err
+	}
+	lockTime, err = time.Parse(time.RFC3339, s[0])
+	return lockTime, s[1], s[2], err
+}
+
+// ReleaseNodeLock 删除节点锁。force为false时只有锁中记录的是这个Pod才会删除，为true时直接删除
+func ReleaseNodeLock(ctx context.Context, client kubernetes.Interface, nodeName string, pod *v1.Pod, force bool) error {
+	lockMu.Lock()
+	defer lockMu.Unlock()
+	var err error
+	for i := 0; i < maxLockRetry; i++ {
+		if i > 0 {
+			klog.ErrorS(err, "failed to release node lock, retrying", "node", nodeName, "retry", i)
+			time.Sleep(100 * time.Millisecond)
+		}
+		var node *v1.Node
+		node, err = client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+		if err != nil {
+			continue
+		}
+		value, ok := node.Annotations[NodeLockKey]
+		if !ok {
+			return nil
+		}
+		if !force && !lockedBy(value, pod) {
+			klog.InfoS("node lock is not held by this pod", "lock", value, "pod", klog.KObj(pod))
+			return nil
+		}
+		newNode := node.DeepCopy()
+		delete(newNode.Annotations, NodeLockKey)
+		if _, err = client.CoreV1().Nodes().Update(ctx, newNode, metav1.UpdateOptions{}); err == nil {
+			klog.InfoS("node lock released", "node", nodeName, "pod", klog.KObj(pod))
+			return nil
+		}
+	}
+	return fmt.Errorf("release node lock exceeds retry count %d: %v", maxLockRetry, err)
+}
+
+// lockedBy 新格式的锁比较namespace和name，只有时间的旧格式无法判断，与HAMi一样按照Pod名匹配
+func lockedBy(value string, pod *v1.Pod) bool {
+	_, ns, name, err := ParseNodeLock(value)
+	if err == nil && name != "" {
+		return ns == pod.Namespace && name == pod.Name
+	}
+	return strings.Contains(value, pod.Name)
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hami
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestReleaseNodeLock(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "infer-0"}}
+	tests := []struct {
+		name     string
+		lock     string
+		force    bool
+		released bool
+	}{
+		{"held by pod", "2025-07-10T07:48:33Z,default,infer-0", false, true},
+		{"held by another pod", "2025-07-10T07:48:33Z,default,infer-1", false, false},
+		{"same name in another namespace", "2025-07-10T07:48:33Z,other,infer-0", false, false},
+		{"held by another pod forced", "2025-07-10T07:48:33Z,default,infer-1", true, true},
+		{"legacy lock without pod", "2025-07-10T07:48:33Z", false, false},
+		{"not locked", "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Annotations: map[string]string{}}}
+			if tt.lock != "" {
+				node.Annotations[NodeLockKey] = tt.lock
+			}
+			client := fake.NewSimpleClientset(node)
+			if err := ReleaseNodeLock(context.Background(), client, "node1", pod, tt.force); err != nil {
+				t.Fatalf("ReleaseNodeLock() error = %v", err)
+			}
+			got, err := client.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, locked := got.Annotations[NodeLockKey]; locked == tt.released {
+				t.Errorf("ReleaseNodeLock() left lock %q, want released %v", got.Annotations[NodeLockKey], tt.released)
+			}
+		})
+	}
+}
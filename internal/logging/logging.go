@@ -0,0 +1,223 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package logging 统一插件自己的klog日志和昇腾驱动接口的hwlog日志。
+// 所有日志都通过klog输出，使用同一个-v控制级别，支持text和json两种格式，每一行都带上节点名
+package logging
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	"k8s.io/klog/v2"
+	"k8s.io/klog/v2/textlogger"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+
+	// hwlogDebugVerbosity -v大于等于这个值时打开hwlog的debug日志，hwlog的debug日志也在这个级别输出
+	hwlogDebugVerbosity = 4
+)
+
+// Setup 根据格式设置klog的后端，需要在flag.Parse之后调用
+func Setup(format, nodeName string) error {
+	v := Verbosity()
+	var logger logr.Logger
+	switch format {
+	case FormatText:
+		logger = textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(v)))
+	case FormatJSON:
+		logger = funcr.NewJSON(func(obj string) {
+			fmt.Fprintln(os.Stderr, obj)
+		}, funcr.Options{LogCaller: funcr.All, LogTimestamp: true, Verbosity: v})
+	default:
+		return fmt.Errorf("unknown log format %s, expected %s or %s", format, FormatText, FormatJSON)
+	}
+	if nodeName != "" {
+		logger = logger.WithValues("node", nodeName)
+	}
+	klog.SetLogger(logger)
+	return nil
+}
+
+// Verbosity klog的-v参数
+func Verbosity() int {
+	f := flag.Lookup("v")
+	if f == nil {
+		return 0
+	}
+	v, _ := strconv.Atoi(f.Value.String())
+	return v
+}
+
+// HWLogLevel 根据klog的-v参数得到hwlog的日志级别，-1为debug，0为info
+func HWLogLevel() int {
+	if Verbosity() >= hwlogDebugVerbosity {
+		return -1
+	}
+	return 0
+}
+
+const (
+	// hwlogPipe HWLogSink中命名管道的文件名
+	hwlogPipe = "hwlog.pipe"
+	// hwlogDrainTimeout 关闭HWLogSink时等待读完管道中剩余日志的时间
+	hwlogDrainTimeout = 100 * time.Millisecond
+)
+
+// HWLogSink hwlog只能输出到标准输出或者日志文件，并且在初始化时就固定了输出的位置。
+// HWLogSink创建一个命名管道作为hwlog的日志文件，读取之后逐行交给handle处理，不需要替换进程的标准输出
+type HWLogSink struct {
+	dir  string
+	file *os.File
+	done chan struct{}
+}
+
+// NewHWLogSink 创建命名管道并开始读取，之后把Path()作为hwlog的日志文件
+func NewHWLogSink(handle func(line string)) (*HWLogSink, error) {
+	dir, err := os.MkdirTemp("", "hwlog")
+	if err != nil {
+		return nil, err
+	}
+	// hwlog要求日志文件的路径中没有软链接，临时目录本身可能在软链接下面
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, hwlogPipe)
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, fmt.Errorf("create hwlog pipe %s error: %v", path, err)
+	}
+	// 以读写方式打开，不需要等待hwlog打开管道，hwlog关闭或者重新打开管道时也不会读到EOF
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, fmt.Errorf("open hwlog pipe %s error: %v", path, err)
+	}
+	s := &HWLogSink{dir: dir, file: file, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		forwardHWLog(file, handle)
+	}()
+	return s, nil
+}
+
+// Path hwlog日志文件的路径
+func (s *HWLogSink) Path() string {
+	return filepath.Join(s.dir, hwlogPipe)
+}
+
+// Close 读完管道中剩余的日志之后停止读取并删除命名管道，之后写入的hwlog日志被丢弃
+func (s *HWLogSink) Close() error {
+	// 管道以读写方式打开，读取时不会遇到EOF，通过超时结束读取
+	if err := s.file.SetReadDeadline(time.Now().Add(hwlogDrainTimeout)); err != nil {
+		_ = s.file.Close()
+	}
+	<-s.done
+	err := s.file.Close()
+	if rerr := os.RemoveAll(s.dir); err == nil || errors.Is(err, os.ErrClosed) {
+		err = rerr
+	}
+	return err
+}
+
+// KlogHandler 把hwlog日志按照原来的级别转发到klog
+func KlogHandler() func(line string) {
+	logger := klog.Background().WithValues("source", "hwlog")
+	return func(line string) {
+		logHWLogLine(logger, line)
+	}
+}
+
+// WriterHandler 把hwlog日志原样写到w
+func WriterHandler(w io.Writer) func(line string) {
+	return func(line string) {
+		_, _ = fmt.Fprintln(w, line)
+	}
+}
+
+// hwlog的日志格式: [INFO]     2024/07/10 07:48:33.123456 1       devmanager/devmanager.go:100    message
+var hwlogLine = regexp.MustCompile(`^\[(\w+)\]\s+\S+\s+\S+\s+\d+\s+(\S+:\d+)\s+(.*)$`)
+
+// maxHWLogLine 单行hwlog日志的最大长度，超过的部分被丢弃
+const maxHWLogLine = 64 * 1024
+
+// forwardHWLog 一直读取管道直到管道被关闭。管道没有被读取时写满之后所有的hwlog调用都会阻塞，
+// 包括健康检查和Allocate中的驱动调用，因此超长的行只截断，读取出错之后也继续丢弃剩下的内容
+func forwardHWLog(r io.Reader, handle func(line string)) {
+	reader := bufio.NewReaderSize(r, maxHWLogLine)
+	for {
+		line, err := readHWLogLine(reader)
+		if line = strings.TrimSpace(line); line != "" {
+			handle(line)
+		}
+		if err == io.EOF || errors.Is(err, os.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded) {
+			return
+		}
+		if err != nil {
+			klog.Errorf("forward hwlog error: %v, discarding further hwlog output", err)
+			_, _ = io.Copy(io.Discard, r)
+			return
+		}
+	}
+}
+
+// readHWLogLine 读取一行，超过maxHWLogLine的部分被丢弃
+func readHWLogLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line) < maxHWLogLine {
+			line = append(line, chunk[:min(len(chunk), maxHWLogLine-len(line))]...)
+		}
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+func logHWLogLine(logger klog.Logger, line string) {
+	level, msg := "INFO", line
+	var kvs []interface{}
+	if m := hwlogLine.FindStringSubmatch(line); m != nil {
+		level, msg = m[1], m[3]
+		kvs = append(kvs, "location", m[2])
+	}
+	switch level {
+	case "DEBUG":
+		logger.V(hwlogDebugVerbosity).Info(msg, kvs...)
+	case "WARN":
+		logger.Info(msg, append(kvs, "severity", "warning")...)
+	case "ERROR", "CRITICAL":
+		logger.Error(nil, msg, append(kvs, "severity", strings.ToLower(level))...)
+	default:
+		logger.Info(msg, kvs...)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logging
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHWLogSink(t *testing.T) {
+	var mu sync.Mutex
+	var lines []string
+	sink, err := NewHWLogSink(func(line string) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, line)
+	})
+	if err != nil {
+		t.Fatalf("NewHWLogSink() error = %v", err)
+	}
+	// 与hwlog一样以追加方式打开日志文件，写完之后关闭
+	f, err := os.OpenFile(sink.Path(), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("x", maxHWLogLine+10)
+	for _, line := range []string{"[INFO]     2024/07/10 07:48:33.123456 1       devmanager/devmanager.go:100    first", "", long, "last"} {
+		if _, err := f.WriteString(line + "\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	want := []string{"[INFO]     2024/07/10 07:48:33.123456 1       devmanager/devmanager.go:100    first", long[:maxHWLogLine], "last"}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(lines, want) {
+		t.Errorf("forwarded %d lines, want %d: %q", len(lines), len(want), lines)
+	}
+	if _, err := os.Stat(sink.Path()); !os.IsNotExist(err) {
+		t.Errorf("pipe %s not removed after Close: %v", sink.Path(), err)
+	}
+}
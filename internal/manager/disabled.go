@@ -0,0 +1,71 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package manager
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DisabledFromConfig 配置文件中的disabledDevices
+	DisabledFromConfig = "config"
+	// DisabledFromAnnotation 节点上的hami.io/ascend-disabled-devices注解
+	DisabledFromAnnotation = "annotation"
+)
+
+// ParseDisabledDevices 解析逗号分隔的UUID或者物理ID列表
+func ParseDisabledDevices(value string) []string {
+	var ids []string
+	for _, id := range strings.Split(value, ",") {
+		id = strings.TrimSpace(id)
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// SetDisabledDevices 设置某一个来源中需要停止对外提供服务的卡，返回是否发生了变化
+func (am *AscendManager) SetDisabledDevices(source string, ids []string) bool {
+	am.disabledMu.Lock()
+	defer am.disabledMu.Unlock()
+	if slices.Equal(am.disabled[source], ids) {
+		return false
+	}
+	klog.InfoS("disabled devices changed", "source", source, "from", am.disabled[source], "to", ids)
+	am.disabled[source] = ids
+	return true
+}
+
+// IsDisabled 判断卡是否被手动停止对外提供服务，UUID或者物理ID匹配任意一个来源即可
+func (am *AscendManager) IsDisabled(dev *Device) bool {
+	am.disabledMu.RLock()
+	defer am.disabledMu.RUnlock()
+	phyID := fmt.Sprint(dev.PhyID)
+	for _, ids := range am.disabled {
+		for _, id := range ids {
+			if id == dev.UUID || id == phyID {
+				return true
+			}
+		}
+	}
+	return false
+}
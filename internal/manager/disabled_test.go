@@ -0,0 +1,69 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package manager
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseDisabledDevices(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"", nil},
+		{"3", []string{"3"}},
+		{" 0, ,uuid-1 ,", []string{"0", "uuid-1"}},
+	}
+	for _, tt := range tests {
+		if got := ParseDisabledDevices(tt.value); !slices.Equal(got, tt.want) {
+			t.Errorf("ParseDisabledDevices(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestIsDisabled(t *testing.T) {
+	am := &AscendManager{disabled: map[string][]string{}}
+	dev0 := &Device{PhyID: 0, UUID: "uuid-0"}
+	dev1 := &Device{PhyID: 1, UUID: "uuid-1"}
+	steps := []struct {
+		name        string
+		source      string
+		ids         []string
+		wantChanged bool
+		want0       bool
+		want1       bool
+	}{
+		{"physical id from config", DisabledFromConfig, []string{"0"}, true, true, false},
+		{"uuid from annotation", DisabledFromAnnotation, []string{"uuid-1"}, true, true, true},
+		{"same ids unchanged", DisabledFromAnnotation, []string{"uuid-1"}, false, true, true},
+		{"annotation removed", DisabledFromAnnotation, nil, true, true, false},
+		{"config cleared", DisabledFromConfig, nil, true, false, false},
+	}
+	for _, step := range steps {
+		if changed := am.SetDisabledDevices(step.source, step.ids); changed != step.wantChanged {
+			t.Errorf("%s: SetDisabledDevices() = %v, want %v", step.name, changed, step.wantChanged)
+		}
+		if got := am.IsDisabled(dev0); got != step.want0 {
+			t.Errorf("%s: IsDisabled(dev0) = %v, want %v", step.name, got, step.want0)
+		}
+		if got := am.IsDisabled(dev1); got != step.want1 {
+			t.Errorf("%s: IsDisabled(dev1) = %v, want %v", step.name, got, step.want1)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package manager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/metrics"
+)
+
+// flapDetector 记录每张卡健康状态变化的时间，在滑动窗口内变化次数过多的卡会被隔离一段时间
+type flapDetector struct {
+	config      internal.FlapConfig
+	lastHealth  map[int32]bool
+	transitions map[int32][]time.Time
+	quarantine  map[int32]time.Time // 隔离结束的时间
+	now         func() time.Time
+}
+
+func newFlapDetector() *flapDetector {
+	fc := internal.FlapConfig{}
+	fc.SetDefaults()
+	return &flapDetector{
+		config:      fc,
+		lastHealth:  map[int32]bool{},
+		transitions: map[int32][]time.Time{},
+		quarantine:  map[int32]time.Time{},
+		now:         time.Now,
+	}
+}
+
+// SetFlapConfig 设置设备健康状态抖动检测的配置
+func (am *AscendManager) SetFlapConfig(fc internal.FlapConfig) {
+	fc.SetDefaults()
+	am.flapMu.Lock()
+	defer am.flapMu.Unlock()
+	am.flap.config = fc
+}
+
+// observeHealth 记录一次健康检查的结果，返回当前卡是否处于隔离状态
+func (am *AscendManager) observeHealth(logicID int32, healthy bool) bool {
+	am.flapMu.Lock()
+	defer am.flapMu.Unlock()
+	fd := am.flap
+	if fd.config.Disabled {
+		return false
+	}
+	now := fd.now()
+	uuid, phyID := am.deviceLabels(logicID)
+	last, ok := fd.lastHealth[logicID]
+	fd.lastHealth[logicID] = healthy
+	if ok && last != healthy {
+		metrics.DeviceHealthTransitions.WithLabelValues(uuid, phyID).Inc()
+		// 只保留滑动窗口内的状态变化
+		window := fd.transitions[logicID][:0]
+		for _, t := range fd.transitions[logicID] {
+			if now.Sub(t) < fd.config.Window.Duration {
+				window = append(window, t)
+			}
+		}
+		fd.transitions[logicID] = append(window, now)
+		if len(fd.transitions[logicID]) >= fd.config.Threshold {
+			if _, quarantined := fd.quarantine[logicID]; !quarantined {
+				deviceLogger(uuid, logicID).Info("device health is flapping, quarantined",
+					"transitions", len(fd.transitions[logicID]), "window", fd.config.Window.Duration, "cooldown", fd.config.Cooldown.Duration)
+			}
+			fd.quarantine[logicID] = now.Add(fd.config.Cooldown.Duration)
+			fd.transitions[logicID] = nil
+		}
+	}
+	until, quarantined := fd.quarantine[logicID]
+	if quarantined && now.After(until) {
+		deviceLogger(uuid, logicID).Info("device quarantine expired")
+		delete(fd.quarantine, logicID)
+		quarantined = false
+	}
+	if quarantined {
+		metrics.DeviceQuarantined.WithLabelValues(uuid, phyID).Set(1)
+	} else {
+		metrics.DeviceQuarantined.WithLabelValues(uuid, phyID).Set(0)
+	}
+	return quarantined
+}
+
+// quarantinedUntil 返回卡的隔离结束时间，没有被隔离时返回零值
+func (am *AscendManager) quarantinedUntil(logicID int32) time.Time {
+	am.flapMu.Lock()
+	defer am.flapMu.Unlock()
+	until, ok := am.flap.quarantine[logicID]
+	if !ok || am.flap.now().After(until) {
+		return time.Time{}
+	}
+	return until
+}
+
+func (am *AscendManager) deviceLabels(logicID int32) (string, string) {
+	for _, dev := range am.GetDevices() {
+		if dev.LogicID == logicID {
+			return dev.UUID, fmt.Sprint(dev.PhyID)
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestObserveHealth(t *testing.T) {
+	type step struct {
+		after   time.Duration // 距离上一次健康检查的时间
+		healthy bool
+		want    bool
+	}
+	config := internal.FlapConfig{
+		Window:    metav1.Duration{Duration: time.Minute},
+		Threshold: 3,
+		Cooldown:  metav1.Duration{Duration: 10 * time.Minute},
+	}
+	tests := []struct {
+		name     string
+		disabled bool
+		steps    []step
+	}{
+		{
+			name: "stays healthy",
+			steps: []step{
+				{0, true, false}, {time.Second, true, false}, {time.Second, true, false},
+			},
+		},
+		{
+			name: "first observation is not a transition",
+			steps: []step{
+				{0, false, false}, {time.Second, true, false}, {time.Second, false, false},
+			},
+		},
+		{
+			name: "quarantined at threshold",
+			steps: []step{
+				{0, true, false}, {time.Second, false, false}, {time.Second, true, false}, {time.Second, false, true},
+				// 隔离期间恢复健康仍然处于隔离状态
+				{time.Second, true, true}, {time.Minute, true, true},
+			},
+		},
+		{
+			name: "transitions outside the window do not count",
+			steps: []step{
+				{0, true, false}, {time.Second, false, false}, {time.Second, true, false},
+				{2 * time.Minute, false, false}, {time.Second, true, false}, {time.Second, false, true},
+			},
+		},
+		{
+			name: "recovers after cooldown",
+			steps: []step{
+				{0, true, false}, {time.Second, false, false}, {time.Second, true, false}, {time.Second, false, true},
+				{10*time.Minute - time.Second, false, true}, {2 * time.Second, false, false},
+			},
+		},
+		{
+			name: "flapping during quarantine extends it",
+			steps: []step{
+				{0, true, false}, {time.Second, false, false}, {time.Second, true, false}, {time.Second, false, true},
+				{5 * time.Minute, true, true}, {time.Second, false, true}, {time.Second, true, true},
+				{6 * time.Minute, true, true}, {5 * time.Minute, true, false},
+			},
+		},
+		{
+			name:     "disabled",
+			disabled: true,
+			steps: []step{
+				{0, true, false}, {time.Second, false, false}, {time.Second, true, false}, {time.Second, false, false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2024, 7, 10, 0, 0, 0, 0, time.UTC)
+			am := &AscendManager{flap: newFlapDetector()}
+			am.flap.now = func() time.Time { return now }
+			fc := config
+			fc.Disabled = tt.disabled
+			am.SetFlapConfig(fc)
+			for i, s := range tt.steps {
+				now = now.Add(s.after)
+				if got := am.observeHealth(0, s.healthy); got != s.want {
+					t.Fatalf("step %d: observeHealth(%v) = %v, want %v", i, s.healthy, got, s.want)
+				}
+				if got := !am.quarantinedUntil(0).IsZero(); got != s.want {
+					t.Fatalf("step %d: quarantinedUntil() set = %v, want %v", i, got, s.want)
+				}
+			}
+		})
+	}
+}
@@ -17,10 +17,18 @@
 package manager
 
 import (
+	"context"
 	"fmt"
-	"sort"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Project-HAMi/ascend-device-plugin/internal"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"huawei.com/npu-exporter/v6/devmanager"
 	"huawei.com/npu-exporter/v6/devmanager/dcmi"
 	"k8s.io/klog/v2"
@@ -35,14 +43,70 @@ type Device struct {
 	Memory   int64
 	AICore   int32
 	Health   bool
+	// 驱动返回的健康状态码，0表示健康
+	HealthCode uint32
+	// 健康状态频繁变化的卡会被隔离，隔离期间即使驱动返回健康也会被当作不健康
+	Quarantined      bool
+	QuarantinedUntil time.Time
+	// 驱动中当前已经存在的vNPU，以及这些vNPU占用的显存和AICore
+	VNPUs      []VNPU
+	UsedMemory int64
+	UsedAICore int32
+}
+
+// VNPU 驱动中一个已经创建出来的虚拟设备
+type VNPU struct {
+	VDevID      uint32 `json:"vdevID"`
+	Template    string `json:"template"`
+	Memory      int64  `json:"memory"`
+	AICore      int32  `json:"aiCore"`
+	AICPU       int32  `json:"aiCPU"`
+	Status      uint32 `json:"status"`
+	InUse       bool   `json:"inUse"`
+	ContainerID uint64 `json:"containerID,omitempty"`
+}
+
+// LeftoverVNPUs 返回没有被任何容器使用的vNPU，一般是容器异常退出后没有被销毁的残留虚拟设备
+func (d *Device) LeftoverVNPUs() []VNPU {
+	var leftover []VNPU
+	for _, v := range d.VNPUs {
+		if !v.InUse {
+			leftover = append(leftover, v)
+		}
+	}
+	return leftover
+}
+
+// Logger 带上卡的UUID和逻辑ID的日志，健康检查、隔离以及分配相关的日志都通过它输出
+func (d *Device) Logger() klog.Logger {
+	return deviceLogger(d.UUID, d.LogicID)
+}
+
+func deviceLogger(uuid string, logicID int32) klog.Logger {
+	return klog.Background().WithValues("device", uuid, "logicID", logicID)
 }
 
 type AscendManager struct {
-	mgr *devmanager.DeviceManager
+	mu sync.RWMutex
+	// 健康检查和注册分别在不同的协程中刷新设备信息，这里保证刷新是串行的，避免旧的结果覆盖新的结果
+	updateMu sync.Mutex
+	mgr      *devmanager.DeviceManager
+	// 配置可以在运行期间更新，config、overrides以及runtime由configMu保护
+	configMu sync.RWMutex
 	//nodeName string  当前节点的配置，这个配置是有用户配置，基本就是我们自己定义的，用户也一般不会更改
 	config internal.VNPUConfig
+	// 当前节点匹配上的覆盖配置名
+	overrides []string
+	// 配置文件中的runtime配置，各种时间间隔和超时时间
+	runtime internal.RuntimeConfig
 	// 通过调用DCMI底层驱动接口获取设别相关信息，包括物理ID、逻辑ID、UUID、内存、AI核心，健康状态等信息
 	devs []*Device
+	// 设备健康状态抖动检测
+	flapMu sync.Mutex
+	flap   *flapDetector
+	// 手动停止对外提供服务的卡，key为来源（配置文件或者节点注解）
+	disabledMu sync.RWMutex
+	disabled   map[string][]string
 }
 
 // NewAscendManager 这里的AscendManager本质上其实就是昇腾DeviceManager的封装, 拥有DCMI接口，因此可以调用底层驱动获取芯片信息
@@ -53,18 +117,26 @@ func NewAscendManager() (*AscendManager, error) {
 		return nil, err
 	}
 	return &AscendManager{
-		mgr:  mgr,
-		devs: []*Device{},
+		mgr:      mgr,
+		devs:     []*Device{},
+		flap:     newFlapDetector(),
+		disabled: map[string][]string{},
 	}, nil
 }
 
-// LoadConfig 通过驱动获取当前节点芯片的配置信息，通过芯片的名字找到当前芯片的配置，并对当前芯片的虚拟化模板按照从小到大的顺序排序
-func (am *AscendManager) LoadConfig(path string) error {
+// LoadConfig 读取配置文件并应用到当前节点，见ApplyConfig
+func (am *AscendManager) LoadConfig(path string, nodeLabels map[string]string) error {
 	// 记录每一种不同类型的芯片的型号，以及资源名，显存大小，AICore, AICpu的大小。以及可以分配的模板
 	config, err := internal.LoadConfig(path)
 	if err != nil {
 		return err
 	}
+	return am.ApplyConfig(config, nodeLabels)
+}
+
+// ApplyConfig 通过驱动获取当前节点芯片的配置信息，通过芯片的名字找到当前芯片的配置，合并当前节点匹配上的覆盖配置，并对当前芯片的虚拟化模板按照从小到大的顺序排序。
+// 运行期间可以重复调用来更新配置，但是commonWord和resourceName决定了socket以及注解的名字，运行期间不允许修改
+func (am *AscendManager) ApplyConfig(config *internal.Config, nodeLabels map[string]string) error {
 	// 通过驱动获取芯片信息
 	chipInfo, err := am.mgr.GetValidChipInfo()
 	if err != nil {
@@ -73,95 +145,204 @@ func (am *AscendManager) LoadConfig(path string) error {
 	if chipInfo.Type != "Ascend" {
 		return fmt.Errorf("chip type is not Ascend")
 	}
-	idx := -1
-	// 找到当前芯片的配置索引，一般来说一台机器只可能插入一种类型的芯片，不可能插入多种类型的芯片，因此这里需要获取当前节点芯片类型的配置索引
-	for i, vnpu := range config.VNPUs {
-		if vnpu.ChipName == chipInfo.Name {
-			idx = i
-			break
-		}
+	// 找到当前芯片的配置，一般来说一台机器只可能插入一种类型的芯片，不可能插入多种类型的芯片，因此这里需要获取当前节点芯片类型的配置
+	vnpuConfig, overrides, err := config.SelectVNPUConfig(chipInfo.Name, nodeLabels)
+	if err != nil {
+		return err
+	}
+	if len(overrides) > 0 {
+		klog.Infof("node overrides applied: %v", overrides)
 	}
-	if idx == -1 {
-		return fmt.Errorf("can not find vnpu config for chip %s", chipInfo.Name)
+	am.configMu.Lock()
+	if am.config.CommonWord != "" && (am.config.CommonWord != vnpuConfig.CommonWord || am.config.ResourceName != vnpuConfig.ResourceName) {
+		am.configMu.Unlock()
+		return fmt.Errorf("commonWord/resourceName changed from %s/%s to %s/%s, restart the plugin to apply",
+			am.config.CommonWord, am.config.ResourceName, vnpuConfig.CommonWord, vnpuConfig.ResourceName)
 	}
 	// 获取配置
-	am.config = config.VNPUs[idx]
-	// 显存按照从小到大排序，方便后续找到合适的显存模板
-	// hami的算力切分，本质上就是通过昇腾模板来进行切分的，类似于英伟达的MIG
-	sort.Slice(am.config.Templates, func(i, j int) bool {
-		return am.config.Templates[i].Memory < am.config.Templates[j].Memory
-	})
-	klog.Infof("load config: %v", am.config)
+	am.config = *vnpuConfig
+	am.overrides = overrides
+	am.runtime = config.Runtime
+	am.configMu.Unlock()
+	am.SetDisabledDevices(DisabledFromConfig, config.DisabledDevices)
+	klog.Infof("load config: %v", *vnpuConfig)
 	return nil
 }
 
+// VNPUConfig 当前节点生效的配置以及匹配上的覆盖配置名
+func (am *AscendManager) VNPUConfig() (internal.VNPUConfig, []string) {
+	am.configMu.RLock()
+	defer am.configMu.RUnlock()
+	return am.config, am.overrides
+}
+
+func (am *AscendManager) RuntimeConfig() internal.RuntimeConfig {
+	am.configMu.RLock()
+	defer am.configMu.RUnlock()
+	return am.runtime
+}
+
 func (am *AscendManager) CommonWord() string {
+	am.configMu.RLock()
+	defer am.configMu.RUnlock()
 	return am.config.CommonWord
 }
 
 func (am *AscendManager) ResourceName() string {
+	am.configMu.RLock()
+	defer am.configMu.RUnlock()
 	return am.config.ResourceName
 }
 
 func (am *AscendManager) VDeviceCount() int {
-	if len(am.config.Templates) == 0 {
-		return 1
-	}
-	// 昇腾的算力切分，本质上就是应用昇腾的模板，因此这里最多可以创建的虚卡数量为可分配内存处于最小模板需要使用的内存大小
-	return int(am.config.MemoryAllocatable / am.config.Templates[0].Memory)
+	am.configMu.RLock()
+	defer am.configMu.RUnlock()
+	return am.config.VDeviceCount()
 }
 
 // UpdateDevice 通过查询驱动获取当前节点所有芯片的信息，包括物理ID、逻辑ID、UUID、内存、AI核心，健康状态等信息
-func (am *AscendManager) UpdateDevice() error {
+func (am *AscendManager) UpdateDevice() (err error) {
+	am.updateMu.Lock()
+	defer am.updateMu.Unlock()
+	ctx, span := tracing.Start(context.Background(), "UpdateDevice")
+	defer func() { tracing.End(span, err) }()
 	// 获取当前节点所有芯片的ID
+	end := traceDCMI(ctx, "GetDeviceList", -1)
 	_, IDs, err := am.mgr.GetDeviceList()
+	end(err)
 	if err != nil {
-		klog.Errorf("failed to get device list: %v", err)
+		klog.ErrorS(err, "failed to get device list")
 		return err
 	}
 
-	am.devs = make([]*Device, 0, len(IDs))
+	config, _ := am.VNPUConfig()
+	devs := make([]*Device, 0, len(IDs))
 	for _, ID := range IDs {
+		logger := klog.Background().WithValues("logicID", ID)
+		end := traceDCMI(ctx, "GetPhysicIDFromLogicID", ID)
 		phyID, err := am.mgr.GetPhysicIDFromLogicID(ID)
+		end(err)
 		if err != nil {
-			klog.Errorf("failed to get physic id from logic id: %v", err)
+			logger.Error(err, "failed to get physic id from logic id")
 			return err
 		}
+		end = traceDCMI(ctx, "GetCardIDDeviceID", ID)
 		cardID, deviceID, err := am.mgr.GetCardIDDeviceID(ID)
+		end(err)
 		if err != nil {
-			klog.Errorf("failed to get card id from device id: %v", err)
+			logger.Error(err, "failed to get card id from device id")
 			return err
 		}
+		end = traceDCMI(ctx, "GetDieID", ID)
 		uuid, err := am.mgr.GetDieID(ID, dcmi.VDIE)
+		end(err)
 		if err != nil {
-			klog.Errorf("failed to get uuid from device id: %v", err)
+			logger.Error(err, "failed to get uuid from device id")
 			return err
 		}
+		end = traceDCMI(ctx, "GetDeviceHealth", ID)
 		health, err := am.mgr.GetDeviceHealth(ID)
+		end(err)
 		if err != nil {
-			klog.Errorf("failed to get device health: %v", err)
+			deviceLogger(uuid, ID).Error(err, "failed to get device health")
 			return err
 		}
-		am.devs = append(am.devs, &Device{
-			UUID:     uuid,
-			LogicID:  ID,
-			PhyID:    phyID,
-			CardID:   cardID,
-			DeviceID: deviceID,
-			Memory:   am.config.MemoryAllocatable,
-			AICore:   am.config.AICore,
-			Health:   health == 0,
-		})
+		quarantinedUntil := am.quarantinedUntil(ID)
+		dev := &Device{
+			UUID:             uuid,
+			LogicID:          ID,
+			PhyID:            phyID,
+			CardID:           cardID,
+			DeviceID:         deviceID,
+			Memory:           config.MemoryAllocatable,
+			AICore:           config.AICore,
+			Health:           health == 0 && quarantinedUntil.IsZero(),
+			HealthCode:       health,
+			Quarantined:      !quarantinedUntil.IsZero(),
+			QuarantinedUntil: quarantinedUntil,
+		}
+		am.fillVNPUs(ctx, dev)
+		devs = append(devs, dev)
 	}
+	am.mu.Lock()
+	am.devs = devs
+	am.mu.Unlock()
 	return nil
 }
 
+// UpdateVNPUs 重新查询每张卡上已经存在的vNPU，设备的其它信息保持不变
+func (am *AscendManager) UpdateVNPUs() {
+	am.updateMu.Lock()
+	defer am.updateMu.Unlock()
+	ctx, span := tracing.Start(context.Background(), "UpdateVNPUs")
+	defer span.End()
+	old := am.GetDevices()
+	devs := make([]*Device, 0, len(old))
+	for _, d := range old {
+		dev := *d
+		am.fillVNPUs(ctx, &dev)
+		devs = append(devs, &dev)
+	}
+	am.mu.Lock()
+	am.devs = devs
+	am.mu.Unlock()
+}
+
+// fillVNPUs 通过驱动查询当前卡上已经创建的vNPU。不支持算力切分的芯片或者驱动查询失败时，认为没有vNPU
+func (am *AscendManager) fillVNPUs(ctx context.Context, dev *Device) {
+	dev.VNPUs = nil
+	dev.UsedMemory = 0
+	dev.UsedAICore = 0
+	end := traceDCMI(ctx, "GetVirtualDeviceInfo", dev.LogicID)
+	info, err := am.mgr.GetVirtualDeviceInfo(dev.LogicID)
+	end(err)
+	if err != nil {
+		dev.Logger().V(5).Info("failed to get virtual device info", "err", err)
+		return
+	}
+	for _, vdev := range info.VDevInfo {
+		v := VNPU{
+			VDevID:      vdev.VDevID,
+			Template:    vdev.QueryInfo.Name,
+			Memory:      int64(vdev.QueryInfo.Computing.MemorySize),
+			AICore:      int32(vdev.QueryInfo.Computing.Aic),
+			AICPU:       int32(vdev.QueryInfo.Computing.DeviceAicpu),
+			Status:      vdev.QueryInfo.Status,
+			InUse:       vdev.QueryInfo.IsContainerUsed != 0,
+			ContainerID: vdev.QueryInfo.ContainerID,
+		}
+		dev.VNPUs = append(dev.VNPUs, v)
+		dev.UsedMemory += v.Memory
+		dev.UsedAICore += v.AICore
+	}
+}
+
+// PCIeInfo 查询卡的PCIe总线地址以及所在的NUMA节点，NUMA节点未知时返回-1
+func (am *AscendManager) PCIeInfo(logicID int32) (string, int, error) {
+	busID, err := am.mgr.GetPCIeBusInfo(logicID)
+	if err != nil {
+		return "", -1, err
+	}
+	busID = strings.ToLower(strings.TrimSpace(busID))
+	data, err := os.ReadFile(filepath.Join("/sys/bus/pci/devices", busID, "numa_node"))
+	if err != nil {
+		return busID, -1, nil
+	}
+	numa, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return busID, -1, nil
+	}
+	return busID, numa, nil
+}
+
 func (am *AscendManager) GetDevices() []*Device {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
 	return am.devs
 }
 
 func (am *AscendManager) GetDeviceByUUID(UUID string) *Device {
-	for _, dev := range am.devs {
+	for _, dev := range am.GetDevices() {
 		if dev.UUID == UUID {
 			return dev
 		}
@@ -178,19 +359,37 @@ func (am *AscendManager) GetIDs() []int32 {
 }
 
 func (am *AscendManager) GetUnHealthIDs() []int32 {
+	ctx, span := tracing.Start(context.Background(), "GetUnHealthIDs")
+	defer span.End()
+	end := traceDCMI(ctx, "GetDeviceList", -1)
 	_, IDs, err := am.mgr.GetDeviceList()
+	end(err)
 	if err != nil {
 		return nil
 	}
 	var unhealthy []int32
 	for _, d := range IDs {
+		end := traceDCMI(ctx, "GetDeviceHealth", d)
 		healthCode, err := am.mgr.GetDeviceHealth(d)
+		end(err)
 		if err != nil {
 			continue
 		}
-		if healthCode != 0 {
+		// 被隔离的卡即使当前是健康的，也当作不健康的卡
+		quarantined := am.observeHealth(d, healthCode == 0)
+		if healthCode != 0 || quarantined {
 			unhealthy = append(unhealthy, d)
 		}
 	}
 	return unhealthy
 }
+
+// traceDCMI 为一次驱动调用创建span，logicID为-1表示与具体的卡无关，返回的函数在调用结束后执行
+func traceDCMI(ctx context.Context, call string, logicID int32) func(error) {
+	var attrs []attribute.KeyValue
+	if logicID >= 0 {
+		attrs = append(attrs, attribute.Int("logicID", int(logicID)))
+	}
+	_, span := tracing.Start(ctx, "dcmi."+call, attrs...)
+	return func(err error) { tracing.End(span, err) }
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package manager
+
+import (
+	"context"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal/tracing"
+	"huawei.com/npu-exporter/v6/devmanager/common"
+)
+
+// Telemetry 一张卡的硬件遥测数据，驱动不支持或者查询失败的字段为nil
+type Telemetry struct {
+	// 芯片温度，单位摄氏度
+	Temperature *int32
+	// 芯片功耗，单位瓦
+	Power *float32
+	// AICore利用率，0-100
+	AICoreUtilization *uint32
+	// HBM总容量以及已经使用的容量，单位MB
+	HBMTotal *uint64
+	HBMUsed  *uint64
+	// HBM的单比特以及双比特ECC错误数
+	ECCSingleBitErrors *int64
+	ECCDoubleBitErrors *int64
+}
+
+// Telemetry 通过驱动查询一张卡的温度、功耗、AICore利用率、HBM使用量以及ECC错误数，
+// 单项查询失败时只跳过这一项，不影响其它数据
+func (am *AscendManager) Telemetry(logicID int32) Telemetry {
+	ctx, span := tracing.Start(context.Background(), "Telemetry")
+	defer span.End()
+	var t Telemetry
+	uuid, _ := am.deviceLabels(logicID)
+	logger := deviceLogger(uuid, logicID).V(5)
+	end := traceDCMI(ctx, "GetDeviceTemperature", logicID)
+	temp, err := am.mgr.GetDeviceTemperature(logicID)
+	end(err)
+	if err == nil {
+		t.Temperature = &temp
+	} else {
+		logger.Info("failed to get temperature", "err", err)
+	}
+	end = traceDCMI(ctx, "GetDevicePowerInfo", logicID)
+	power, err := am.mgr.GetDevicePowerInfo(logicID)
+	end(err)
+	if err == nil {
+		t.Power = &power
+	} else {
+		logger.Info("failed to get power", "err", err)
+	}
+	end = traceDCMI(ctx, "GetDeviceUtilizationRate", logicID)
+	util, err := am.mgr.GetDeviceUtilizationRate(logicID, common.AICore)
+	end(err)
+	if err == nil {
+		t.AICoreUtilization = &util
+	} else {
+		logger.Info("failed to get aicore utilization", "err", err)
+	}
+	end = traceDCMI(ctx, "GetDeviceHbmInfo", logicID)
+	hbm, err := am.mgr.GetDeviceHbmInfo(logicID)
+	end(err)
+	if err == nil && hbm != nil {
+		t.HBMTotal = &hbm.MemorySize
+		t.HBMUsed = &hbm.Usage
+	} else {
+		logger.Info("failed to get hbm info", "err", err)
+	}
+	end = traceDCMI(ctx, "GetDeviceEccInfo", logicID)
+	ecc, err := am.mgr.GetDeviceEccInfo(logicID, common.DcmiDeviceTypeHBM)
+	end(err)
+	if err == nil && ecc != nil {
+		t.ECCSingleBitErrors = &ecc.SingleBitErrorCnt
+		t.ECCDoubleBitErrors = &ecc.DoubleBitErrorCnt
+	} else {
+		logger.Info("failed to get ecc info", "err", err)
+	}
+	return t
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+const namespace = "hami_ascend"
+
+var (
+	// DeviceHealthTransitions 设备健康状态变化的次数
+	DeviceHealthTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "device_health_transitions_total",
+		Help:      "Number of health transitions of the device.",
+	}, []string{"uuid", "phyid"})
+	// DeviceQuarantined 设备是否因为健康状态频繁变化而被隔离
+	DeviceQuarantined = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "device_quarantined",
+		Help:      "Whether the device is quarantined because of health flapping.",
+	}, []string{"uuid", "phyid"})
+	// ContainerDeviceInfo 容器使用的卡以及vNPU模板，值固定为1，用于和硬件指标关联
+	ContainerDeviceInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "container_device_info",
+		Help:      "Device and vNPU template used by a container, always 1.",
+	}, []string{"namespace", "pod", "container", "uuid", "phyid", "template"})
+)
+
+// 硬件遥测指标，同一张卡上有多个Pod时每个Pod一条时间序列，没有Pod使用的卡namespace和pod为空
+var (
+	telemetryLabels = []string{"uuid", "phyid", "namespace", "pod"}
+	// DeviceTemperature 芯片温度
+	DeviceTemperature = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "device_temperature_celsius",
+		Help:      "Temperature of the device in degrees Celsius.",
+	}, telemetryLabels)
+	// DevicePower 芯片功耗
+	DevicePower = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "device_power_watts",
+		Help:      "Power draw of the device in watts.",
+	}, telemetryLabels)
+	// DeviceAICoreUtilization AICore利用率
+	DeviceAICoreUtilization = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "device_aicore_utilization_percent",
+		Help:      "AI core utilization of the device, 0-100.",
+	}, telemetryLabels)
+	// DeviceHBMTotal HBM总容量
+	DeviceHBMTotal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "device_hbm_total_bytes",
+		Help:      "Total HBM of the device in bytes.",
+	}, telemetryLabels)
+	// DeviceHBMUsed HBM已使用的容量
+	DeviceHBMUsed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "device_hbm_used_bytes",
+		Help:      "Used HBM of the device in bytes.",
+	}, telemetryLabels)
+	// DeviceECCErrors HBM的ECC错误数，type为single_bit或者double_bit
+	DeviceECCErrors = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "device_hbm_ecc_errors",
+		Help:      "Number of HBM ECC errors reported by the driver.",
+	}, append(telemetryLabels, "type"))
+
+	telemetryGauges = []*prometheus.GaugeVec{
+		DeviceTemperature, DevicePower, DeviceAICoreUtilization, DeviceHBMTotal, DeviceHBMUsed, DeviceECCErrors,
+	}
+)
+
+func init() {
+	prometheus.MustRegister(DeviceHealthTransitions, DeviceQuarantined, ContainerDeviceInfo)
+	for _, g := range telemetryGauges {
+		prometheus.MustRegister(g)
+	}
+}
+
+// DeleteDeviceTelemetry 删除一张卡的所有遥测指标，卡被移除或者卡上的Pod发生变化时调用
+func DeleteDeviceTelemetry(uuid string) {
+	for _, g := range telemetryGauges {
+		g.DeletePartialMatch(prometheus.Labels{"uuid": uuid})
+	}
+}
+
+// Serve 启动Prometheus指标服务，addr为空时不启动
+func Serve(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	klog.Infof("Starting metrics server on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		klog.Errorf("metrics server on %s exited: %v", addr, err)
+	}
+}
+
+// DeleteContainerDeviceInfo 删除一个Pod中所有容器的设备信息
+func DeleteContainerDeviceInfo(namespace, pod string) {
+	ContainerDeviceInfo.DeletePartialMatch(prometheus.Labels{"namespace": namespace, "pod": pod})
+}
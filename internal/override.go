@@ -0,0 +1,124 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+/* 按照节点标签覆盖部分节点的配置，多个覆盖配置都匹配时按照顺序依次合并，后面的优先级更高
+nodeOverrides:
+- name: reserve-memory
+  nodeSelector:
+    matchLabels:
+      pool: inference
+  vnpus:
+  - chipName: 910B3
+    memoryAllocatable: 61440
+    templates:
+      - name: vir05_1c_16g
+        memory: 16384
+        aiCore: 5
+        aiCPU: 1
+*/
+
+// NodeOverride 覆盖匹配上nodeSelector的节点的配置，vnpus中只需要填写需要覆盖的字段，按照chipName匹配。
+// 对象类型的字段会递归合并，列表类型的字段（例如templates）会整体替换
+type NodeOverride struct {
+	Name         string                `json:"name"`
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector"`
+	VNPUs        []json.RawMessage     `json:"vnpus"`
+}
+
+// EffectiveVNPUConfig 按照芯片名选择配置，并且把当前节点匹配上的覆盖配置合并进去，返回生效的配置以及匹配上的覆盖配置名
+func (c *Config) EffectiveVNPUConfig(chipName string, nodeLabels map[string]string) (*VNPUConfig, []string, error) {
+	var base *VNPUConfig
+	for i := range c.VNPUs {
+		if c.VNPUs[i].ChipName == chipName {
+			base = &c.VNPUs[i]
+			break
+		}
+	}
+	if base == nil {
+		return nil, nil, fmt.Errorf("can not find vnpu config for chip %s", chipName)
+	}
+	merged, err := toMap(base)
+	if err != nil {
+		return nil, nil, err
+	}
+	var matched []string
+	for _, override := range c.NodeOverrides {
+		if override.NodeSelector == nil {
+			continue
+		}
+		selector, err := metav1.LabelSelectorAsSelector(override.NodeSelector)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid nodeSelector of override %s: %v", override.Name, err)
+		}
+		if !selector.Matches(labels.Set(nodeLabels)) {
+			continue
+		}
+		for _, raw := range override.VNPUs {
+			var patch map[string]interface{}
+			if err := json.Unmarshal(raw, &patch); err != nil {
+				return nil, nil, fmt.Errorf("invalid vnpus of override %s: %v", override.Name, err)
+			}
+			if patch["chipName"] != chipName {
+				continue
+			}
+			merged = mergeMap(merged, patch)
+			matched = append(matched, override.Name)
+		}
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, nil, err
+	}
+	var effective VNPUConfig
+	if err := json.Unmarshal(data, &effective); err != nil {
+		return nil, nil, fmt.Errorf("invalid vnpu config after applying overrides %v: %v", matched, err)
+	}
+	return &effective, matched, nil
+}
+
+func toMap(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+// mergeMap 把patch递归合并到base中，只有两边都是对象时才递归合并，其它情况直接使用patch中的值
+func mergeMap(base, patch map[string]interface{}) map[string]interface{} {
+	for k, pv := range patch {
+		bm, bok := base[k].(map[string]interface{})
+		pm, pok := pv.(map[string]interface{})
+		if bok && pok {
+			base[k] = mergeMap(bm, pm)
+			continue
+		}
+		base[k] = pv
+	}
+	return base
+}
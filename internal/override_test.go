@@ -0,0 +1,132 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEffectiveVNPUConfig(t *testing.T) {
+	override := func(name string, selector map[string]string, vnpus ...string) NodeOverride {
+		o := NodeOverride{Name: name}
+		if selector != nil {
+			o.NodeSelector = &metav1.LabelSelector{MatchLabels: selector}
+		}
+		for _, v := range vnpus {
+			o.VNPUs = append(o.VNPUs, json.RawMessage(v))
+		}
+		return o
+	}
+	base := VNPUConfig{
+		ChipName:          "910B3",
+		CommonWord:        "Ascend910B",
+		ResourceName:      "huawei.com/Ascend910B",
+		MemoryAllocatable: 65536,
+		AICore:            20,
+		Templates: []Template{
+			{Name: "vir05_1c_16g", Memory: 16384, AICore: 5, AICPU: 1},
+			{Name: "vir10_3c_32g", Memory: 32768, AICore: 10, AICPU: 3},
+		},
+	}
+	tests := []struct {
+		name        string
+		overrides   []NodeOverride
+		labels      map[string]string
+		wantMatched []string
+		want        func(vc *VNPUConfig)
+	}{
+		{
+			name: "no override matches",
+			overrides: []NodeOverride{
+				override("other-pool", map[string]string{"pool": "training"}, `{"chipName":"910B3","memoryAllocatable":1}`),
+				override("no-selector", nil, `{"chipName":"910B3","memoryAllocatable":2}`),
+			},
+			labels: map[string]string{"pool": "inference"},
+		},
+		{
+			name: "later override wins",
+			overrides: []NodeOverride{
+				override("first", map[string]string{"pool": "inference"}, `{"chipName":"910B3","memoryAllocatable":61440,"aiCore":18}`),
+				override("second", map[string]string{"zone": "a"}, `{"chipName":"910B3","memoryAllocatable":57344}`),
+			},
+			labels:      map[string]string{"pool": "inference", "zone": "a"},
+			wantMatched: []string{"first", "second"},
+			want: func(vc *VNPUConfig) {
+				vc.MemoryAllocatable = 57344
+				vc.AICore = 18
+			},
+		},
+		{
+			name: "templates replaced as a whole",
+			overrides: []NodeOverride{
+				override("small-templates", map[string]string{"pool": "inference"},
+					`{"chipName":"910B3","templates":[{"name":"vir05_1c_16g","memory":15360,"aiCore":5,"aiCPU":1}]}`),
+			},
+			labels:      map[string]string{"pool": "inference"},
+			wantMatched: []string{"small-templates"},
+			want: func(vc *VNPUConfig) {
+				vc.Templates = []Template{{Name: "vir05_1c_16g", Memory: 15360, AICore: 5, AICPU: 1}}
+			},
+		},
+		{
+			name: "vnpus of other chips ignored",
+			overrides: []NodeOverride{
+				override("mixed", map[string]string{"pool": "inference"},
+					`{"chipName":"910B4","memoryAllocatable":1}`,
+					`{"chipName":"910B3","resourceName":"huawei.com/Ascend910B-inference"}`),
+			},
+			labels:      map[string]string{"pool": "inference"},
+			wantMatched: []string{"mixed"},
+			want: func(vc *VNPUConfig) {
+				vc.ResourceName = "huawei.com/Ascend910B-inference"
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{VNPUs: []VNPUConfig{base}, NodeOverrides: tt.overrides}
+			got, matched, err := config.EffectiveVNPUConfig("910B3", tt.labels)
+			if err != nil {
+				t.Fatalf("EffectiveVNPUConfig() error = %v", err)
+			}
+			want := base
+			if tt.want != nil {
+				tt.want(&want)
+			}
+			if !reflect.DeepEqual(*got, want) {
+				t.Errorf("EffectiveVNPUConfig() = %+v, want %+v", *got, want)
+			}
+			if !reflect.DeepEqual(matched, tt.wantMatched) {
+				t.Errorf("EffectiveVNPUConfig() matched = %v, want %v", matched, tt.wantMatched)
+			}
+		})
+	}
+	if base.Templates[0].Memory != 16384 {
+		t.Errorf("EffectiveVNPUConfig() modified the base config")
+	}
+}
+
+func TestEffectiveVNPUConfigUnknownChip(t *testing.T) {
+	config := &Config{VNPUs: []VNPUConfig{{ChipName: "910B3"}}}
+	if _, _, err := config.EffectiveVNPUConfig("910B4", nil); err == nil {
+		t.Errorf("EffectiveVNPUConfig() of unknown chip should fail")
+	}
+}
@@ -0,0 +1,228 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	DefaultHealthCheckInterval = 5 * time.Second
+	DefaultRegisterInterval    = 10 * time.Second
+	DefaultHandshakeInterval   = 30 * time.Second
+	DefaultOutOfServicePeriod  = 30 * time.Second
+	DefaultErrorBackoff        = 5 * time.Second
+	DefaultErrorBackoffJitter  = 0.2
+	DefaultDialTimeout         = 5 * time.Second
+	DefaultReportTimeOffset    = 1 * time.Second
+	DefaultTelemetryInterval   = 30 * time.Second
+	DefaultShutdownGracePeriod = 10 * time.Second
+
+	DefaultTaintKey          = "huawei.com/npu-unhealthy"
+	DefaultTaintEffect       = v1.TaintEffectNoSchedule
+	DefaultTaintThreshold    = 1
+	DefaultTaintRecoverDelay = 5 * time.Minute
+
+	DefaultFlapWindow    = 10 * time.Minute
+	DefaultFlapThreshold = 6
+	DefaultFlapCooldown  = 30 * time.Minute
+)
+
+/* 配置文件中可选的runtime配置如下，没有配置的字段使用默认值，命令行参数的优先级高于配置文件
+runtime:
+  healthCheckInterval: 5s
+  registerInterval: 10s
+  handshakeInterval: 30s
+  outOfServicePeriod: 30s
+  errorBackoff: 5s
+  errorBackoffJitter: 0.2
+  dialTimeout: 5s
+  reportTimeOffset: 1s
+  telemetryInterval: 30s
+  shutdownGracePeriod: 10s
+  unregisterOnShutdown: false
+  taint:
+    enabled: false
+    key: huawei.com/npu-unhealthy
+    effect: NoSchedule
+    threshold: 1
+    recoverThreshold: 0
+    recoverDelay: 5m
+  flap:
+    disabled: false
+    window: 10m
+    threshold: 6
+    cooldown: 30m
+*/
+
+// RuntimeConfig 插件运行过程中的各种时间间隔和超时时间
+type RuntimeConfig struct {
+	// 查询设备健康状态的间隔，只有健康状态发生变化时才会通知kubelet
+	HealthCheckInterval metav1.Duration `json:"healthCheckInterval,omitempty"`
+	// 检查设备信息是否需要重新注册到节点注解的间隔，只有设备信息发生变化时才会更新节点注解
+	RegisterInterval metav1.Duration `json:"registerInterval,omitempty"`
+	// 刷新握手注解的间隔，需要小于HAMi调度器判断节点握手超时的时间（60s）
+	HandshakeInterval metav1.Duration `json:"handshakeInterval,omitempty"`
+	// 调度器写入Deleted_之后设备停止服务的时间，期间不向kubelet和调度器上报设备，之后重新上报让调度器重新纳管
+	OutOfServicePeriod metav1.Duration `json:"outOfServicePeriod,omitempty"`
+	// 注册失败之后的重试间隔，实际的间隔会在[errorBackoff, errorBackoff*(1+errorBackoffJitter))之间随机
+	// 没有配置时为0.2，配置为0时不加抖动
+	ErrorBackoff       metav1.Duration `json:"errorBackoff,omitempty"`
+	ErrorBackoffJitter *float64        `json:"errorBackoffJitter,omitempty"`
+	// 连接device plugin socket以及kubelet socket的超时时间
+	DialTimeout metav1.Duration `json:"dialTimeout,omitempty"`
+	// 握手注解中上报时间的偏移量，没有配置时为1s，配置为0时不偏移
+	ReportTimeOffset *metav1.Duration `json:"reportTimeOffset,omitempty"`
+	// 采集温度、功耗等硬件遥测数据的间隔，只有开启了metrics服务时才会采集
+	TelemetryInterval metav1.Duration `json:"telemetryInterval,omitempty"`
+	// 退出时等待正在进行的Allocate完成的时间，超时之后取消这些Allocate并释放节点锁
+	ShutdownGracePeriod metav1.Duration `json:"shutdownGracePeriod,omitempty"`
+	// 退出时把注册到节点上的设备都标记为不健康，避免调度器在插件重新启动之前继续向当前节点调度
+	UnregisterOnShutdown bool `json:"unregisterOnShutdown,omitempty"`
+	// 不健康的卡过多时自动给节点打污点
+	Taint TaintConfig `json:"taint,omitempty"`
+	// 健康状态频繁变化的卡会被隔离一段时间
+	Flap FlapConfig `json:"flap,omitempty"`
+}
+
+// FlapConfig 一张卡在window时间内健康状态变化的次数达到threshold时，在cooldown时间内一直被当作不健康的卡
+type FlapConfig struct {
+	Disabled  bool            `json:"disabled,omitempty"`
+	Window    metav1.Duration `json:"window,omitempty"`
+	Threshold int             `json:"threshold,omitempty"`
+	Cooldown  metav1.Duration `json:"cooldown,omitempty"`
+}
+
+// TaintConfig 不健康的卡数量达到threshold时给当前节点打上污点，
+// 降到recoverThreshold及以下并且持续recoverDelay之后才移除污点，避免设备状态抖动时反复打污点
+type TaintConfig struct {
+	Enabled          bool            `json:"enabled,omitempty"`
+	Key              string          `json:"key,omitempty"`
+	Effect           v1.TaintEffect  `json:"effect,omitempty"`
+	Threshold        int             `json:"threshold,omitempty"`
+	RecoverThreshold *int            `json:"recoverThreshold,omitempty"`
+	RecoverDelay     metav1.Duration `json:"recoverDelay,omitempty"`
+}
+
+// SetDefaults 填充没有配置的字段
+func (rc *RuntimeConfig) SetDefaults() {
+	setDefaultDuration(&rc.HealthCheckInterval, DefaultHealthCheckInterval)
+	setDefaultDuration(&rc.RegisterInterval, DefaultRegisterInterval)
+	setDefaultDuration(&rc.HandshakeInterval, DefaultHandshakeInterval)
+	setDefaultDuration(&rc.OutOfServicePeriod, DefaultOutOfServicePeriod)
+	setDefaultDuration(&rc.ErrorBackoff, DefaultErrorBackoff)
+	setDefaultDuration(&rc.DialTimeout, DefaultDialTimeout)
+	setDefaultDuration(&rc.TelemetryInterval, DefaultTelemetryInterval)
+	setDefaultDuration(&rc.ShutdownGracePeriod, DefaultShutdownGracePeriod)
+	if rc.ReportTimeOffset == nil {
+		rc.ReportTimeOffset = &metav1.Duration{Duration: DefaultReportTimeOffset}
+	}
+	if rc.ErrorBackoffJitter == nil {
+		jitter := DefaultErrorBackoffJitter
+		rc.ErrorBackoffJitter = &jitter
+	}
+	rc.Taint.SetDefaults()
+	rc.Flap.SetDefaults()
+}
+
+// Validate 校验配置的值，时间间隔不能为负数，污点的recoverThreshold必须小于threshold。没有配置（为0）的时间间隔由SetDefaults填充
+func (rc *RuntimeConfig) Validate() error {
+	durations := map[string]metav1.Duration{
+		"healthCheckInterval": rc.HealthCheckInterval,
+		"registerInterval":    rc.RegisterInterval,
+		"handshakeInterval":   rc.HandshakeInterval,
+		"outOfServicePeriod":  rc.OutOfServicePeriod,
+		"errorBackoff":        rc.ErrorBackoff,
+		"dialTimeout":         rc.DialTimeout,
+		"telemetryInterval":   rc.TelemetryInterval,
+		"shutdownGracePeriod": rc.ShutdownGracePeriod,
+		"taint.recoverDelay":  rc.Taint.RecoverDelay,
+		"flap.window":         rc.Flap.Window,
+		"flap.cooldown":       rc.Flap.Cooldown,
+	}
+	if rc.ReportTimeOffset != nil {
+		durations["reportTimeOffset"] = *rc.ReportTimeOffset
+	}
+	var errs []error
+	for name, d := range durations {
+		if d.Duration < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %v", name, d.Duration))
+		}
+	}
+	if rc.ErrorBackoffJitter != nil && *rc.ErrorBackoffJitter < 0 {
+		errs = append(errs, fmt.Errorf("errorBackoffJitter must not be negative, got %v", *rc.ErrorBackoffJitter))
+	}
+	if err := rc.Taint.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	// 按照字段名排序，保证错误信息稳定
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return errors.Join(errs...)
+}
+
+// Validate recoverThreshold必须小于threshold，否则污点打上之后会立即满足移除的条件
+func (tc *TaintConfig) Validate() error {
+	if tc.RecoverThreshold == nil {
+		return nil
+	}
+	threshold := tc.Threshold
+	if threshold <= 0 {
+		threshold = DefaultTaintThreshold
+	}
+	if *tc.RecoverThreshold < 0 || *tc.RecoverThreshold >= threshold {
+		return fmt.Errorf("taint.recoverThreshold must be in [0, %d), got %d", threshold, *tc.RecoverThreshold)
+	}
+	return nil
+}
+
+func (tc *TaintConfig) SetDefaults() {
+	if tc.Key == "" {
+		tc.Key = DefaultTaintKey
+	}
+	if tc.Effect == "" {
+		tc.Effect = DefaultTaintEffect
+	}
+	if tc.Threshold <= 0 {
+		tc.Threshold = DefaultTaintThreshold
+	}
+	if tc.RecoverThreshold == nil {
+		recoverThreshold := tc.Threshold - 1
+		tc.RecoverThreshold = &recoverThreshold
+	}
+	setDefaultDuration(&tc.RecoverDelay, DefaultTaintRecoverDelay)
+}
+
+func setDefaultDuration(d *metav1.Duration, def time.Duration) {
+	if d.Duration <= 0 {
+		d.Duration = def
+	}
+}
+
+func (fc *FlapConfig) SetDefaults() {
+	setDefaultDuration(&fc.Window, DefaultFlapWindow)
+	setDefaultDuration(&fc.Cooldown, DefaultFlapCooldown)
+	if fc.Threshold <= 0 {
+		fc.Threshold = DefaultFlapThreshold
+	}
+}
@@ -0,0 +1,45 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import "testing"
+
+func TestTaintConfigValidate(t *testing.T) {
+	intPtr := func(i int) *int { return &i }
+	tests := []struct {
+		name             string
+		threshold        int
+		recoverThreshold *int
+		wantErr          bool
+	}{
+		{"recover threshold not set", 3, nil, false},
+		{"recover threshold below threshold", 3, intPtr(2), false},
+		{"recover threshold equals threshold", 3, intPtr(3), true},
+		{"recover threshold above threshold", 3, intPtr(5), true},
+		{"negative recover threshold", 3, intPtr(-1), true},
+		{"default threshold", 0, intPtr(0), false},
+		{"above default threshold", 0, intPtr(1), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := RuntimeConfig{Taint: TaintConfig{Threshold: tt.threshold, RecoverThreshold: tt.recoverThreshold}}
+			if err := rc.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
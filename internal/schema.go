@@ -0,0 +1,145 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	sigsjson "sigs.k8s.io/json"
+)
+
+/* 配置的版本
+apiVersion: ascend.hami.io/v1
+kind: AscendDeviceConfig
+vnpus:
+- chipName: 910B3
+  ...
+
+不带apiVersion和kind的配置是HAMi调度器ConfigMap中使用的旧格式，ConfigMap中还包含其它厂商的配置，因此旧格式忽略不认识的字段。
+带版本的配置严格解析，不认识的字段直接报错，避免拼写错误被静默忽略。
+修改配置格式时增加新的版本，并在configConversions中增加从上一个版本转换过来的函数
+*/
+
+const (
+	ConfigAPIVersion = "ascend.hami.io/v1"
+	ConfigKind       = "AscendDeviceConfig"
+	// legacyConfigVersion 不带apiVersion的旧格式
+	legacyConfigVersion = ""
+)
+
+// configConversions 把某个版本的配置转换为下一个版本，key为转换前的版本。转换函数需要修改apiVersion，依次转换直到ConfigAPIVersion
+var configConversions = map[string]func(obj map[string]interface{}) error{
+	legacyConfigVersion: convertLegacyConfig,
+}
+
+// convertLegacyConfig 旧格式和v1的字段相同，只需要补上apiVersion和kind
+func convertLegacyConfig(obj map[string]interface{}) error {
+	obj["apiVersion"] = ConfigAPIVersion
+	obj["kind"] = ConfigKind
+	return nil
+}
+
+// SupportedConfigVersions 可以解析的配置版本
+func SupportedConfigVersions() []string {
+	versions := []string{ConfigAPIVersion}
+	for v := range configConversions {
+		if v != legacyConfigVersion {
+			versions = append(versions, v)
+		}
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// decodeConfig 把任意支持的版本转换为当前版本之后解析
+func decodeConfig(obj map[string]interface{}) (*Config, error) {
+	apiVersion, _ := obj["apiVersion"].(string)
+	strict := apiVersion != legacyConfigVersion
+	for version := apiVersion; version != ConfigAPIVersion; {
+		convert, ok := configConversions[version]
+		if !ok {
+			return nil, fmt.Errorf("unsupported apiVersion %q, supported versions are %s",
+				version, strings.Join(SupportedConfigVersions(), ", "))
+		}
+		if err := convert(obj); err != nil {
+			return nil, fmt.Errorf("convert config from apiVersion %q failed: %w", version, err)
+		}
+		next, _ := obj["apiVersion"].(string)
+		if next == version {
+			return nil, fmt.Errorf("conversion of apiVersion %q did not change the version", version)
+		}
+		version = next
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if !strict {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("invalid config: %w", err)
+		}
+	} else {
+		// 严格模式下字段名区分大小写，并且不允许出现不认识的字段和重复的字段
+		strictErrs, err := sigsjson.UnmarshalStrict(data, &config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s config: %w", ConfigAPIVersion, err)
+		}
+		if len(strictErrs) > 0 {
+			return nil, fmt.Errorf("invalid %s config: %w", ConfigAPIVersion, errors.Join(strictErrs...))
+		}
+		if err := checkOverrides(config.NodeOverrides); err != nil {
+			return nil, fmt.Errorf("invalid %s config: %w", ConfigAPIVersion, err)
+		}
+	}
+	if err := config.Runtime.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid runtime config: %w", err)
+	}
+	return &config, nil
+}
+
+// checkOverrides 覆盖配置的vnpus保留原始的JSON用于合并，严格模式下单独按照VNPUConfig严格解析一次，
+// 避免覆盖配置中拼错的字段被静默忽略
+func checkOverrides(overrides []NodeOverride) error {
+	for _, override := range overrides {
+		for i, raw := range override.VNPUs {
+			var vc VNPUConfig
+			strictErrs, err := sigsjson.UnmarshalStrict(raw, &vc)
+			if err != nil {
+				return fmt.Errorf("vnpus[%d] of override %s: %w", i, override.Name, err)
+			}
+			if len(strictErrs) > 0 {
+				return fmt.Errorf("vnpus[%d] of override %s: %w", i, override.Name, errors.Join(strictErrs...))
+			}
+		}
+	}
+	return nil
+}
+
+// SetDefaults 填充芯片配置的默认值，需要在合并覆盖配置之后调用，这样覆盖配置修改resourceName时resourceMemoryName也会跟着变化
+func (vc *VNPUConfig) SetDefaults() {
+	if vc.ResourceMemoryName == "" && vc.ResourceName != "" {
+		vc.ResourceMemoryName = vc.ResourceName + "-memory"
+	}
+	if vc.MemoryCapacity == 0 {
+		vc.MemoryCapacity = vc.MemoryAllocatable
+	}
+}
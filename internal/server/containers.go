@@ -0,0 +1,211 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal/hami"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/metrics"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// ContainerDevice 一个容器使用的一张卡以及对应的vNPU模板，整卡时模板为空
+type ContainerDevice struct {
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod"`
+	UID       types.UID `json:"uid"`
+	// 调度器的注解与Pod中的容器对应不上时为空
+	Container string `json:"container,omitempty"`
+	UUID      string `json:"uuid"`
+	// 当前节点上找不到这张卡时为-1
+	PhyID    int32  `json:"phyID"`
+	Template string `json:"template,omitempty"`
+}
+
+// containerDevices 当前节点上已经分配了设备并且还没有结束的Pod中每个容器使用的卡，
+// 由Pod informer维护，启动时informer的全量同步会根据Pod注解重建
+type containerDevices struct {
+	mu   sync.RWMutex
+	pods map[types.UID][]ContainerDevice
+}
+
+// set 更新一个Pod使用的卡，devs为空时删除这个Pod，返回是否有变化
+func (c *containerDevices) set(uid types.UID, devs []ContainerDevice) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(devs) == 0 {
+		if _, ok := c.pods[uid]; !ok {
+			return false
+		}
+		delete(c.pods, uid)
+		return true
+	}
+	if slices.Equal(c.pods[uid], devs) {
+		return false
+	}
+	if c.pods == nil {
+		c.pods = make(map[types.UID][]ContainerDevice)
+	}
+	c.pods[uid] = devs
+	return true
+}
+
+func (c *containerDevices) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pods = nil
+}
+
+// list 按照namespace、Pod、容器以及物理ID排序返回
+func (c *containerDevices) list() []ContainerDevice {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	result := make([]ContainerDevice, 0, len(c.pods))
+	for _, devs := range c.pods {
+		result = append(result, devs...)
+	}
+	slices.SortFunc(result, func(a, b ContainerDevice) int {
+		return cmp.Or(
+			strings.Compare(a.Namespace, b.Namespace),
+			strings.Compare(a.Pod, b.Pod),
+			strings.Compare(a.Container, b.Container),
+			cmp.Compare(a.PhyID, b.PhyID),
+		)
+	})
+	return result
+}
+
+// ContainerDevices 返回当前节点上每个容器使用的卡
+func (ps *PluginServer) ContainerDevices() []ContainerDevice {
+	return ps.containers.list()
+}
+
+func (ps *PluginServer) addContainerDevicesHandler(informer cache.SharedIndexInformer) error {
+	// 重新启动时informer会重新同步所有的Pod，清空之前的结果避免残留已经删除的Pod
+	ps.containers.reset()
+	metrics.ContainerDeviceInfo.Reset()
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pod, ok := obj.(*v1.Pod); ok {
+				ps.updateContainerDevices(pod)
+			}
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			if pod, ok := newObj.(*v1.Pod); ok {
+				ps.updateContainerDevices(pod)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if pod, ok := obj.(*v1.Pod); ok {
+				ps.setContainerDevices(pod, nil)
+			}
+		},
+	})
+	return err
+}
+
+// updateContainerDevices 只记录已经成功分配了设备并且还没有结束的Pod
+func (ps *PluginServer) updateContainerDevices(pod *v1.Pod) {
+	if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed ||
+		pod.Annotations[hami.DeviceBindPhase] != hami.DeviceBindSuccess {
+		ps.setContainerDevices(pod, nil)
+		return
+	}
+	ps.setContainerDevices(pod, ps.podContainerDevices(pod))
+}
+
+func (ps *PluginServer) setContainerDevices(pod *v1.Pod, devs []ContainerDevice) {
+	if !ps.containers.set(pod.UID, devs) {
+		return
+	}
+	metrics.DeleteContainerDeviceInfo(pod.Namespace, pod.Name)
+	for _, d := range devs {
+		phyID := ""
+		if d.PhyID >= 0 {
+			phyID = fmt.Sprint(d.PhyID)
+		}
+		metrics.ContainerDeviceInfo.WithLabelValues(d.Namespace, d.Pod, d.Container, d.UUID, phyID, d.Template).Set(1)
+	}
+	klog.V(4).InfoS("container devices changed", "pod", klog.KObj(pod), "devices", devs)
+}
+
+// podContainerDevices 根据调度器写入的注解解析Pod中每个容器使用的卡。
+// hami.io/<commonWord>-devices-allocated按照Pod中容器的顺序记录每个容器的卡，模板只在huawei.com/<commonWord>中
+func (ps *PluginServer) podContainerDevices(pod *v1.Pod) []ContainerDevice {
+	rtInfo, err := ps.podRuntimeInfo(pod)
+	if err != nil {
+		return nil
+	}
+	temps := make(map[string]string, len(rtInfo))
+	var uuids []string
+	for _, info := range rtInfo {
+		if info.UUID != "" {
+			temps[info.UUID] = info.Temp
+			uuids = append(uuids, info.UUID)
+		}
+	}
+	newDevice := func(container, uuid string) ContainerDevice {
+		d := ContainerDevice{
+			Namespace: pod.Namespace,
+			Pod:       pod.Name,
+			UID:       pod.UID,
+			Container: container,
+			UUID:      uuid,
+			PhyID:     -1,
+			Template:  temps[uuid],
+		}
+		if dev := ps.mgr.GetDeviceByUUID(uuid); dev != nil {
+			d.PhyID = dev.PhyID
+		}
+		return d
+	}
+	var devs []ContainerDevice
+	segments := strings.Split(strings.TrimSuffix(pod.Annotations[ps.allocatedAnno], hami.OnePodMultiContainerSplitSymbol),
+		hami.OnePodMultiContainerSplitSymbol)
+	if len(segments) == len(pod.Spec.Containers) {
+		for i, s := range segments {
+			cd, err := hami.DecodeContainerDevices(s)
+			if err != nil {
+				break
+			}
+			for _, d := range cd {
+				if _, ok := temps[d.UUID]; ok {
+					devs = append(devs, newDevice(pod.Spec.Containers[i].Name, d.UUID))
+				}
+			}
+		}
+	}
+	if len(devs) > 0 {
+		return devs
+	}
+	// 容器对应不上时只记录Pod使用的卡
+	for _, uuid := range uuids {
+		devs = append(devs, newDevice("", uuid))
+	}
+	return devs
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal/audit"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/manager"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/klog/v2"
+)
+
+// maxAllocationRecords 调试接口保留的最近的分配结果数量
+const maxAllocationRecords = 100
+
+// debugState 调试接口需要的状态，注册协程和Allocate写入，调试接口读取
+type debugState struct {
+	mu             sync.Mutex
+	register       string
+	handshake      string
+	publishedAt    time.Time
+	allocations    []audit.Record
+	nextAllocation int
+}
+
+func (d *debugState) setPublished(register, handshake string, t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.register, d.handshake, d.publishedAt = register, handshake, t
+}
+
+func (d *debugState) addAllocation(r audit.Record) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.allocations) < maxAllocationRecords {
+		d.allocations = append(d.allocations, r)
+		return
+	}
+	d.allocations[d.nextAllocation] = r
+	d.nextAllocation = (d.nextAllocation + 1) % maxAllocationRecords
+}
+
+// recentAllocations 按照时间从新到旧返回
+func (d *debugState) recentAllocations() []audit.Record {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	records := make([]audit.Record, 0, len(d.allocations))
+	for i := len(d.allocations) - 1; i >= 0; i-- {
+		records = append(records, d.allocations[(d.nextAllocation+i)%len(d.allocations)])
+	}
+	return records
+}
+
+type vnpuStatus struct {
+	UUID       string         `json:"uuid"`
+	PhyID      int32          `json:"phyID"`
+	UsedMemory int64          `json:"usedMemory"`
+	UsedAICore int32          `json:"usedAICore"`
+	VNPUs      []manager.VNPU `json:"vnpus"`
+}
+
+// ServeDebug 启动调试用的HTTP服务，addr为空时不启动。调试接口没有鉴权，因此只允许监听回环地址
+func (ps *PluginServer) ServeDebug(addr string) {
+	if addr == "" {
+		return
+	}
+	if err := checkLoopback(addr); err != nil {
+		klog.Errorf("debug server not started: %v", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/", ps.handleIndex)
+	mux.HandleFunc("/debug/vnpus", ps.handleVNPUs)
+	mux.HandleFunc("/debug/config", ps.handleConfig)
+	mux.HandleFunc("/debug/devices", ps.handleDevices)
+	mux.HandleFunc("/debug/kubelet", ps.handleKubelet)
+	mux.HandleFunc("/debug/register", ps.handleRegister)
+	mux.HandleFunc("/debug/allocations", ps.handleAllocations)
+	mux.HandleFunc("/debug/containers", ps.handleContainers)
+	klog.Infof("Starting debug server on %s", addr)
+	if err := http.ListenAndServe(addr, loopbackOnly(mux)); err != nil {
+		klog.Errorf("debug server on %s exited: %v", addr, err)
+	}
+}
+
+// checkLoopback 监听地址必须是回环地址，例如127.0.0.1:9099、[::1]:9099或者localhost:9099
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid debug address %s: %v", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("debug address %s is not a loopback address", addr)
+	}
+	return nil
+}
+
+// loopbackOnly 再次检查请求的来源，插件使用hostNetwork时也只能从节点本机访问
+func loopbackOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (ps *PluginServer) handleIndex(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, []string{
+		"/debug/config", "/debug/devices", "/debug/vnpus", "/debug/kubelet", "/debug/register", "/debug/allocations",
+		"/debug/containers",
+	})
+}
+
+// 每张卡上驱动中当前存在的vNPU
+func (ps *PluginServer) handleVNPUs(w http.ResponseWriter, _ *http.Request) {
+	devs := ps.mgr.GetDevices()
+	status := make([]vnpuStatus, 0, len(devs))
+	for _, dev := range devs {
+		status = append(status, vnpuStatus{
+			UUID:       dev.UUID,
+			PhyID:      dev.PhyID,
+			UsedMemory: dev.UsedMemory,
+			UsedAICore: dev.UsedAICore,
+			VNPUs:      dev.VNPUs,
+		})
+	}
+	writeJSON(w, status)
+}
+
+// 当前节点生效的配置以及匹配上的覆盖配置
+func (ps *PluginServer) handleConfig(w http.ResponseWriter, _ *http.Request) {
+	config, overrides := ps.mgr.VNPUConfig()
+	writeJSON(w, map[string]interface{}{
+		"vnpu":      config,
+		"overrides": overrides,
+		"runtime":   ps.runtime,
+	})
+}
+
+// 通过驱动发现的设备
+func (ps *PluginServer) handleDevices(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, ps.mgr.GetDevices())
+}
+
+// 当前上报给kubelet的设备列表
+func (ps *PluginServer) handleKubelet(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"resourceName": ps.mgr.ResourceName(),
+		"devices":      ps.apiDevices(),
+	})
+}
+
+// 插件最后一次写入的注解，以及节点上当前的注解（可能已经被调度器修改）
+func (ps *PluginServer) handleRegister(w http.ResponseWriter, _ *http.Request) {
+	ps.debug.mu.Lock()
+	published := map[string]interface{}{
+		ps.registerAnno:  ps.debug.register,
+		ps.handshakeAnno: ps.debug.handshake,
+		"time":           ps.debug.publishedAt,
+	}
+	ps.debug.mu.Unlock()
+	current := map[string]string{}
+	if node, err := ps.cachedNode(); err == nil {
+		current[ps.registerAnno] = node.Annotations[ps.registerAnno]
+		current[ps.handshakeAnno] = node.Annotations[ps.handshakeAnno]
+	}
+	writeJSON(w, map[string]interface{}{
+		"published": published,
+		"node":      current,
+	})
+}
+
+// 最近的Allocate结果，从新到旧，与审计日志中的记录相同
+func (ps *PluginServer) handleAllocations(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, ps.debug.recentAllocations())
+}
+
+// 当前节点上每个容器使用的卡以及模板
+func (ps *PluginServer) handleContainers(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, ps.ContainerDevices())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
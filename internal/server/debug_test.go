@@ -0,0 +1,63 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal/manager"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// 调试接口在informer启动以及重启期间也可能被访问，使用-race运行时可以发现对informer字段的并发读写
+func TestHandleRegisterDuringInformerRestart(t *testing.T) {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNode}}
+	ps := &PluginServer{
+		nodeName:   testNode,
+		mgr:        &manager.AscendManager{},
+		client:     fake.NewSimpleClientset(node),
+		healthCh:   make(chan int32, 1),
+		registerCh: make(chan struct{}, 1),
+		now:        time.Now,
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 3; i++ {
+			ps.stopCh = make(chan interface{})
+			if err := ps.startInformers(); err != nil {
+				t.Errorf("startInformers() error = %v", err)
+			}
+			close(ps.stopCh)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		w := httptest.NewRecorder()
+		ps.handleRegister(w, httptest.NewRequest(http.MethodGet, "/debug/register", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("handleRegister() status = %d", w.Code)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,48 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/Project-HAMi/ascend-device-plugin/internal/manager"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// DisabledDevicesAnno 节点上停止对外提供服务的卡，逗号分隔的UUID或者物理ID，例如 hami.io/ascend-disabled-devices: "0,3"
+const DisabledDevicesAnno = "hami.io/ascend-disabled-devices"
+
+// addDisabledDevicesHandler 监听节点上的停用设备注解，变化之后立即通知kubelet和调度器
+func (ps *PluginServer) addDisabledDevicesHandler(informer cache.SharedIndexInformer) error {
+	handle := func(obj interface{}) {
+		node, ok := obj.(*v1.Node)
+		if !ok {
+			return
+		}
+		ids := manager.ParseDisabledDevices(node.Annotations[DisabledDevicesAnno])
+		if ps.mgr.SetDisabledDevices(manager.DisabledFromAnnotation, ids) {
+			ps.notifyKubelet()
+			ps.requestRegister()
+		}
+	}
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: handle,
+		UpdateFunc: func(_, newObj interface{}) {
+			handle(newObj)
+		},
+	})
+	return err
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+/*
+HAMi调度器与插件之间通过握手注解进行交互：
+  - 插件定期写入 Reported_<time>，表示插件还活着
+  - 调度器写入 Requesting_<time>，要求插件尽快重新上报，超过60s没有收到上报就认为插件已经异常
+  - 调度器写入 Deleted_<time>，表示调度器已经把当前节点上的设备移除了
+*/
+const (
+	handshakeRequesting = "Requesting_"
+	handshakeDeleted    = "Deleted_"
+)
+
+// processStart 插件进程的启动时间，早于这个时间写入的Deleted_是插件停止期间调度器留下的
+var processStart = time.Now()
+
+// addHandshakeHandler 处理调度器写入当前节点的握手注解
+func (ps *PluginServer) addHandshakeHandler(informer cache.SharedIndexInformer) error {
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if node, ok := obj.(*v1.Node); ok {
+				ps.handleInitialHandshake(node.Annotations[ps.handshakeAnno])
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode, ok := oldObj.(*v1.Node)
+			if !ok {
+				return
+			}
+			newNode, ok := newObj.(*v1.Node)
+			if !ok {
+				return
+			}
+			ps.handleHandshake(oldNode.Annotations[ps.handshakeAnno], newNode.Annotations[ps.handshakeAnno])
+		},
+	})
+	return err
+}
+
+// handleInitialHandshake 处理informer启动时节点上已有的握手注解。插件停止超过60s之后调度器会写入Deleted_，
+// 这是插件重新启动的正常情况，此时立即重新上报，而不是把设备停止服务
+func (ps *PluginServer) handleInitialHandshake(value string) {
+	if strings.HasPrefix(value, handshakeDeleted) {
+		deletedAt, err := time.ParseInLocation(time.DateTime, strings.TrimPrefix(value, handshakeDeleted), time.Local)
+		if err != nil || deletedAt.Before(processStart) {
+			klog.InfoS("devices were removed by scheduler before the plugin started, registering again", "handshake", value)
+			ps.requestRegister()
+			return
+		}
+	}
+	ps.handleHandshake("", value)
+}
+
+func (ps *PluginServer) handleHandshake(oldValue, value string) {
+	if value == oldValue {
+		return
+	}
+	switch {
+	case strings.HasPrefix(value, handshakeRequesting):
+		klog.InfoS("scheduler requested a report", "handshake", value)
+		ps.requestRegister()
+	case strings.HasPrefix(value, handshakeDeleted):
+		klog.InfoS("scheduler removed devices, take devices out of service", "handshake", value,
+			"period", ps.runtime.OutOfServicePeriod.Duration)
+		ps.handshakeMu.Lock()
+		ps.deletedAt = ps.now()
+		ps.handshakeMu.Unlock()
+		ps.notifyKubelet()
+	}
+}
+
+// outOfService 调度器移除设备之后，在outOfServicePeriod时间内不再向kubelet和调度器上报设备
+func (ps *PluginServer) outOfService() bool {
+	ps.handshakeMu.Lock()
+	defer ps.handshakeMu.Unlock()
+	return !ps.deletedAt.IsZero() && ps.now().Sub(ps.deletedAt) < ps.runtime.OutOfServicePeriod.Duration
+}
+
+// backInService 停止服务的时间到了之后清除停止服务的状态，返回true表示设备刚刚恢复服务，需要重新上报。
+// 只在注册协程中调用，最多在registerInterval之后恢复
+func (ps *PluginServer) backInService() bool {
+	ps.handshakeMu.Lock()
+	defer ps.handshakeMu.Unlock()
+	if ps.deletedAt.IsZero() || ps.now().Sub(ps.deletedAt) < ps.runtime.OutOfServicePeriod.Duration {
+		return false
+	}
+	ps.deletedAt = time.Time{}
+	return true
+}
+
+// requestRegister 让注册协程尽快强制上报一次
+func (ps *PluginServer) requestRegister() {
+	select {
+	case ps.registerCh <- struct{}{}:
+	default:
+	}
+}
+
+// notifyKubelet 通知ListAndWatch重新上报设备，已经有未处理的通知时直接合并
+func (ps *PluginServer) notifyKubelet() {
+	select {
+	case ps.healthCh <- 0:
+	default:
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newHandshakeServer(now *time.Time) *PluginServer {
+	return &PluginServer{
+		nodeName:   testNode,
+		runtime:    internal.RuntimeConfig{OutOfServicePeriod: metav1.Duration{Duration: 30 * time.Second}},
+		healthCh:   make(chan int32, 1),
+		registerCh: make(chan struct{}, 1),
+		now:        func() time.Time { return *now },
+	}
+}
+
+func TestHandleHandshake(t *testing.T) {
+	beforeStart := handshakeDeleted + processStart.Add(-time.Minute).Format(time.DateTime)
+	afterStart := handshakeDeleted + processStart.Add(time.Minute).Format(time.DateTime)
+	tests := []struct {
+		name     string
+		initial  bool
+		old      string
+		value    string
+		register bool // 是否要求注册协程立即上报
+		notify   bool // 是否通知kubelet
+		out      bool // 设备是否停止服务
+	}{
+		{name: "requesting", old: "Reported_2025.07.10 07:48:33", value: "Requesting_2025-07-10 07:48:40", register: true},
+		{name: "unchanged requesting", old: "Requesting_2025-07-10 07:48:40", value: "Requesting_2025-07-10 07:48:40"},
+		{name: "reported by plugin", old: "Requesting_2025-07-10 07:48:40", value: "Reported_2025.07.10 07:48:41"},
+		{name: "deleted", old: "Requesting_2025-07-10 07:48:40", value: afterStart, notify: true, out: true},
+		{name: "initial requesting", initial: true, value: "Requesting_2025-07-10 07:48:40", register: true},
+		{name: "initial deleted before process start", initial: true, value: beforeStart, register: true},
+		{name: "initial deleted with unknown time", initial: true, value: handshakeDeleted + "unknown", register: true},
+		{name: "initial deleted after process start", initial: true, value: afterStart, notify: true, out: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			ps := newHandshakeServer(&now)
+			if tt.initial {
+				ps.handleInitialHandshake(tt.value)
+			} else {
+				ps.handleHandshake(tt.old, tt.value)
+			}
+			if got := len(ps.registerCh) == 1; got != tt.register {
+				t.Errorf("register requested = %v, want %v", got, tt.register)
+			}
+			if got := len(ps.healthCh) == 1; got != tt.notify {
+				t.Errorf("kubelet notified = %v, want %v", got, tt.notify)
+			}
+			if got := ps.outOfService(); got != tt.out {
+				t.Errorf("outOfService() = %v, want %v", got, tt.out)
+			}
+		})
+	}
+}
+
+func TestOutOfServicePeriod(t *testing.T) {
+	now := time.Now()
+	ps := newHandshakeServer(&now)
+	ps.handleHandshake("", handshakeDeleted+now.Format(time.DateTime))
+	<-ps.healthCh
+
+	now = now.Add(29 * time.Second)
+	if !ps.outOfService() {
+		t.Fatalf("devices should be out of service before outOfServicePeriod")
+	}
+	if ps.backInService() {
+		t.Fatalf("devices should not be back in service before outOfServicePeriod")
+	}
+
+	now = now.Add(time.Second)
+	if ps.outOfService() {
+		t.Fatalf("devices should be in service after outOfServicePeriod")
+	}
+	// outOfService只做检查，不会通知kubelet和注册协程，也不会清除状态
+	if len(ps.healthCh) != 0 || len(ps.registerCh) != 0 {
+		t.Fatalf("outOfService should not notify kubelet or request register")
+	}
+	if !ps.backInService() {
+		t.Fatalf("backInService() = false after outOfServicePeriod, want true")
+	}
+	if ps.backInService() {
+		t.Fatalf("backInService() should only return true once")
+	}
+
+	// 再次收到Deleted_时重新停止服务
+	ps.handleHandshake(handshakeDeleted+"2025-07-10 07:48:33", handshakeDeleted+now.Format(time.DateTime))
+	if !ps.outOfService() {
+		t.Fatalf("devices should be out of service after another Deleted_")
+	}
+}
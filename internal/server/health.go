@@ -0,0 +1,136 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal/manager"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/tracing"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// NodeConditionNPUHealthy 汇总当前节点上NPU健康状态的节点Condition
+	NodeConditionNPUHealthy v1.NodeConditionType = "AscendNPUHealthy"
+
+	eventReasonUnhealthy = "NPUUnhealthy"
+	eventReasonHealthy   = "NPUHealthy"
+)
+
+// newEventRecorder dry run模式下Event只打印日志，不写入API Server
+func newEventRecorder(client kubernetes.Interface, dryRun bool) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	if dryRun || client == nil {
+		broadcaster.StartLogging(func(format string, args ...interface{}) {
+			klog.Infof("dry run: "+format, args...)
+		})
+	} else {
+		broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	}
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "hami-ascend-device-plugin"})
+}
+
+// nodeRef 节点上的Event按照kubelet的惯例使用节点名作为UID
+func (ps *PluginServer) nodeRef() *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind: "Node",
+		Name: ps.nodeName,
+		UID:  types.UID(ps.nodeName),
+	}
+}
+
+// reportHealth 为每一张健康状态发生变化的卡记录Event，并且更新节点上汇总NPU健康状态的Condition
+func (ps *PluginServer) reportHealth(lastUnhealthy, unhealthy []int32) {
+	devs := ps.mgr.GetDevices()
+	for _, dev := range devs {
+		was := slices.Contains(lastUnhealthy, dev.LogicID)
+		is := slices.Contains(unhealthy, dev.LogicID)
+		switch {
+		case is && !was:
+			dev.Logger().Info("device became unhealthy", "phyID", dev.PhyID, "healthCode", dev.HealthCode)
+			ps.recorder.Eventf(ps.nodeRef(), v1.EventTypeWarning, eventReasonUnhealthy,
+				"%s device %s (phyID %d) became unhealthy", ps.mgr.CommonWord(), dev.UUID, dev.PhyID)
+		case was && !is:
+			dev.Logger().Info("device recovered", "phyID", dev.PhyID)
+			ps.recorder.Eventf(ps.nodeRef(), v1.EventTypeNormal, eventReasonHealthy,
+				"%s device %s (phyID %d) recovered", ps.mgr.CommonWord(), dev.UUID, dev.PhyID)
+		}
+	}
+	if err := ps.patchHealthCondition(devs, unhealthy); err != nil {
+		klog.ErrorS(err, "failed to patch node condition", "condition", NodeConditionNPUHealthy)
+	}
+}
+
+func (ps *PluginServer) patchHealthCondition(devs []*manager.Device, unhealthy []int32) error {
+	condition := v1.NodeCondition{
+		Type:               NodeConditionNPUHealthy,
+		Status:             v1.ConditionTrue,
+		LastHeartbeatTime:  metav1.Now(),
+		LastTransitionTime: metav1.Now(),
+		Reason:             eventReasonHealthy,
+		Message:            fmt.Sprintf("all %d %s devices are healthy", len(devs), ps.mgr.CommonWord()),
+	}
+	if len(unhealthy) > 0 {
+		var phyIDs []string
+		for _, dev := range devs {
+			if slices.Contains(unhealthy, dev.LogicID) {
+				phyIDs = append(phyIDs, fmt.Sprint(dev.PhyID))
+			}
+		}
+		condition.Status = v1.ConditionFalse
+		condition.Reason = eventReasonUnhealthy
+		condition.Message = fmt.Sprintf("%d/%d %s devices are unhealthy, phyIDs: %s",
+			len(unhealthy), len(devs), ps.mgr.CommonWord(), strings.Join(phyIDs, ","))
+	}
+	// 状态没有变化时保留原来的LastTransitionTime
+	if node, err := ps.cachedNode(); err == nil {
+		for _, c := range node.Status.Conditions {
+			if c.Type == NodeConditionNPUHealthy && c.Status == condition.Status {
+				condition.LastTransitionTime = c.LastTransitionTime
+			}
+		}
+	}
+	patch := map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []v1.NodeCondition{condition},
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	if ps.dryRun {
+		klog.InfoS("dry run: would patch node status", "patch", string(data))
+		return nil
+	}
+	ctx, span := tracing.Start(context.Background(), "patchNodeStatus")
+	_, err = ps.client.CoreV1().Nodes().PatchStatus(ctx, ps.nodeName, data)
+	tracing.End(span, err)
+	return err
+}
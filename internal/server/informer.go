@@ -0,0 +1,194 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal/hami"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// bindPhaseIndex 按照hami.io/bind-phase注解对Pod建立索引，Allocate时只需要查找处于allocating阶段的Pod
+const bindPhaseIndex = "bindPhase"
+
+// startInformers 启动当前节点以及当前节点上Pod的informer，随着PluginServer的停止而停止
+func (ps *PluginServer) startInformers() error {
+	nodeFactory := informers.NewSharedInformerFactoryWithOptions(ps.client, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", ps.nodeName).String()
+		}))
+	nodeInformer := nodeFactory.Core().V1().Nodes()
+	if err := ps.addHandshakeHandler(nodeInformer.Informer()); err != nil {
+		return fmt.Errorf("add node event handler error: %v", err)
+	}
+	if err := ps.addDisabledDevicesHandler(nodeInformer.Informer()); err != nil {
+		return fmt.Errorf("add node event handler error: %v", err)
+	}
+
+	podFactory := informers.NewSharedInformerFactoryWithOptions(ps.client, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", ps.nodeName).String()
+		}))
+	podInformer := podFactory.Core().V1().Pods()
+	err := podInformer.Informer().AddIndexers(cache.Indexers{bindPhaseIndex: bindPhaseIndexFunc})
+	if err != nil {
+		return fmt.Errorf("add pod indexer error: %v", err)
+	}
+	if err := ps.addContainerDevicesHandler(podInformer.Informer()); err != nil {
+		return fmt.Errorf("add pod event handler error: %v", err)
+	}
+
+	ps.informerMu.Lock()
+	ps.nodeLister = nodeInformer.Lister()
+	ps.podLister = podInformer.Lister()
+	ps.podIndexer = podInformer.Informer().GetIndexer()
+	ps.informersSynced = []cache.InformerSynced{nodeInformer.Informer().HasSynced, podInformer.Informer().HasSynced}
+	ps.informerMu.Unlock()
+
+	// 重启时Start会替换ps.stopCh，这里只等待本次启动的stopCh
+	stop, stopCh := ps.stopCh, make(chan struct{})
+	go func() {
+		<-stop
+		close(stopCh)
+	}()
+	nodeFactory.Start(stopCh)
+	podFactory.Start(stopCh)
+	klog.InfoS("Starting node and pod informers")
+	return nil
+}
+
+func bindPhaseIndexFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return nil, nil
+	}
+	if phase, ok := pod.Annotations[hami.DeviceBindPhase]; ok {
+		return []string{phase}, nil
+	}
+	return nil, nil
+}
+
+func (ps *PluginServer) informersHaveSynced() bool {
+	ps.informerMu.RLock()
+	defer ps.informerMu.RUnlock()
+	if len(ps.informersSynced) == 0 {
+		return false
+	}
+	for _, synced := range ps.informersSynced {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
+// cachedNode 从本地缓存中获取当前节点，informer还没有启动时返回错误
+func (ps *PluginServer) cachedNode() (*v1.Node, error) {
+	ps.informerMu.RLock()
+	lister := ps.nodeLister
+	ps.informerMu.RUnlock()
+	if lister == nil {
+		return nil, fmt.Errorf("informers of node %s not started", ps.nodeName)
+	}
+	return lister.Get(ps.nodeName)
+}
+
+func (ps *PluginServer) cachedPod(namespace, name string) (*v1.Pod, error) {
+	ps.informerMu.RLock()
+	lister := ps.podLister
+	ps.informerMu.RUnlock()
+	if lister == nil {
+		return nil, fmt.Errorf("informers of node %s not started", ps.nodeName)
+	}
+	return lister.Pods(namespace).Get(name)
+}
+
+// cachedAllocatingPods 本地缓存中处于allocating阶段的Pod，还需要通过hami.IsAllocatingPod确认
+func (ps *PluginServer) cachedAllocatingPods() ([]interface{}, error) {
+	ps.informerMu.RLock()
+	indexer := ps.podIndexer
+	ps.informerMu.RUnlock()
+	if indexer == nil {
+		return nil, fmt.Errorf("informers of node %s not started", ps.nodeName)
+	}
+	return indexer.ByIndex(bindPhaseIndex, hami.DeviceBindAllocating)
+}
+
+// getPendingPod 从本地缓存中查找当前需要分配设备的Pod，逻辑与hami.GetPendingPod保持一致。
+// 缓存还没有同步完成或者缓存中的数据还没有跟上调度器的更新时，退回到直接查询API Server
+func (ps *PluginServer) getPendingPod(ctx context.Context) (pod *v1.Pod, err error) {
+	ctx, span := tracing.Start(ctx, "getPendingPod")
+	defer func() { tracing.End(span, err) }()
+	if ps.informersHaveSynced() {
+		pod, err := ps.getPendingPodFromCache()
+		if err == nil {
+			klog.V(5).InfoS("found pending pod from cache", "pod", klog.KObj(pod))
+			span.SetAttributes(attribute.Bool("cache", true))
+			return pod, nil
+		}
+		klog.V(4).InfoS("get pending pod from cache failed, fallback to api server", "err", err)
+	}
+	span.SetAttributes(attribute.Bool("cache", false))
+	return hami.GetPendingPod(ctx, ps.client, ps.nodeName)
+}
+
+func (ps *PluginServer) getPendingPodFromCache() (*v1.Pod, error) {
+	node, err := ps.cachedNode()
+	if err != nil {
+		return nil, err
+	}
+	// 节点锁中记录了当前正在分配设备的Pod
+	if value, ok := node.Annotations[hami.NodeLockKey]; ok {
+		_, ns, name, err := hami.ParseNodeLock(value)
+		if err != nil {
+			return nil, err
+		}
+		if ns != "" && name != "" {
+			pod, err := ps.cachedPod(ns, name)
+			if err != nil {
+				return nil, err
+			}
+			if !hami.IsAllocatingPod(pod, ps.nodeName) {
+				return nil, fmt.Errorf("cached pod %s/%s is not allocating", ns, name)
+			}
+			return pod, nil
+		}
+	}
+	objs, err := ps.cachedAllocatingPods()
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range objs {
+		pod, ok := obj.(*v1.Pod)
+		if !ok {
+			continue
+		}
+		if hami.IsAllocatingPod(pod, ps.nodeName) {
+			return pod, nil
+		}
+	}
+	return nil, fmt.Errorf("no binding pod found in cache on node %s", ps.nodeName)
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal/hami"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	listerv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func lockedNode(holder string) *v1.Node {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNode, Annotations: map[string]string{}}}
+	if holder != "" {
+		node.Annotations[hami.NodeLockKey] = "2025-07-10T07:48:33Z,default," + holder
+	}
+	return node
+}
+
+func TestGetPendingPod(t *testing.T) {
+	onOtherNode := testPod("other-node", hami.DeviceBindAllocating, "")
+	onOtherNode.Annotations[hami.AssignedNodeAnnotations] = "node2"
+	// 缓存还没有收到调度器写入的allocating
+	stale := testPod("infer-0", "", "")
+	tests := []struct {
+		name     string
+		node     *v1.Node
+		cached   []*v1.Pod
+		api      []*v1.Pod
+		unsynced bool
+		want     []string // 多个allocating的Pod时返回其中任意一个
+		wantAPI  bool     // 是否退回到直接查询API Server
+		wantErr  bool
+	}{
+		{
+			name:   "cache hit by node lock",
+			node:   lockedNode("infer-1"),
+			cached: []*v1.Pod{testPod("infer-0", hami.DeviceBindAllocating, ""), testPod("infer-1", hami.DeviceBindAllocating, "")},
+			want:   []string{"infer-1"},
+		},
+		{
+			name:   "cache hit by bind phase index",
+			node:   lockedNode(""),
+			cached: []*v1.Pod{testPod("bound", hami.DeviceBindSuccess, ""), onOtherNode, testPod("infer-0", hami.DeviceBindAllocating, "")},
+			want:   []string{"infer-0"},
+		},
+		{
+			name:   "several allocating pods without node lock",
+			node:   lockedNode(""),
+			cached: []*v1.Pod{testPod("infer-0", hami.DeviceBindAllocating, ""), testPod("infer-1", hami.DeviceBindAllocating, "")},
+			want:   []string{"infer-0", "infer-1"},
+		},
+		{
+			name:    "lock holder missing from cache",
+			node:    lockedNode("infer-0"),
+			api:     []*v1.Pod{testPod("infer-0", hami.DeviceBindAllocating, "")},
+			want:    []string{"infer-0"},
+			wantAPI: true,
+		},
+		{
+			name:    "lock holder not allocating in cache",
+			node:    lockedNode("infer-0"),
+			cached:  []*v1.Pod{stale},
+			api:     []*v1.Pod{testPod("infer-0", hami.DeviceBindAllocating, "")},
+			want:    []string{"infer-0"},
+			wantAPI: true,
+		},
+		{
+			name:     "cache not synced",
+			node:     lockedNode(""),
+			cached:   []*v1.Pod{testPod("infer-0", hami.DeviceBindAllocating, "")},
+			api:      []*v1.Pod{testPod("infer-1", hami.DeviceBindAllocating, "")},
+			unsynced: true,
+			want:     []string{"infer-1"},
+			wantAPI:  true,
+		},
+		{
+			name:    "no allocating pod",
+			node:    lockedNode(""),
+			cached:  []*v1.Pod{testPod("bound", hami.DeviceBindSuccess, "")},
+			api:     []*v1.Pod{testPod("bound", hami.DeviceBindSuccess, "")},
+			wantAPI: true,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			if err := nodeIndexer.Add(tt.node); err != nil {
+				t.Fatal(err)
+			}
+			podIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{bindPhaseIndex: bindPhaseIndexFunc})
+			for _, pod := range tt.cached {
+				if err := podIndexer.Add(pod); err != nil {
+					t.Fatal(err)
+				}
+			}
+			objs := []runtime.Object{tt.node}
+			for _, pod := range tt.api {
+				objs = append(objs, pod)
+			}
+			client := fake.NewSimpleClientset(objs...)
+			ps := &PluginServer{
+				nodeName:        testNode,
+				client:          client,
+				nodeLister:      listerv1.NewNodeLister(nodeIndexer),
+				podLister:       listerv1.NewPodLister(podIndexer),
+				podIndexer:      podIndexer,
+				informersSynced: []cache.InformerSynced{func() bool { return !tt.unsynced }},
+			}
+
+			pod, err := ps.getPendingPod(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getPendingPod() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !slices.Contains(tt.want, pod.Name) {
+				t.Errorf("getPendingPod() = %s, want one of %v", pod.Name, tt.want)
+			}
+			if usedAPI := len(client.Actions()) > 0; usedAPI != tt.wantAPI {
+				t.Errorf("getPendingPod() queried api server = %v, want %v", usedAPI, tt.wantAPI)
+			}
+		})
+	}
+}
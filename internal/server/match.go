@@ -0,0 +1,163 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal/hami"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/klog/v2"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// podRuntimeInfo 解析调度器写入Pod注解中的设备和模板
+func (ps *PluginServer) podRuntimeInfo(pod *v1.Pod) ([]hami.RuntimeInfo, error) {
+	anno, ok := pod.Annotations[ps.allocAnno]
+	if !ok {
+		return nil, fmt.Errorf("annotation %s not set", ps.allocAnno)
+	}
+	var rtInfo []hami.RuntimeInfo
+	err := json.Unmarshal([]byte(anno), &rtInfo)
+	if err != nil {
+		return nil, fmt.Errorf("annotation %s value %s invalid", ps.allocAnno, anno)
+	}
+	return rtInfo, nil
+}
+
+// podUUIDs 调度器为Pod选择的设备UUID，一张卡被选择多次时会出现多次
+func (ps *PluginServer) podUUIDs(pod *v1.Pod) ([]string, error) {
+	rtInfo, err := ps.podRuntimeInfo(pod)
+	if err != nil {
+		return nil, err
+	}
+	var uuids []string
+	for _, info := range rtInfo {
+		if info.UUID != "" {
+			uuids = append(uuids, info.UUID)
+		}
+	}
+	return uuids, nil
+}
+
+// deviceUUID 从上报给kubelet的设备ID（<uuid>-<i>）中解析出设备的UUID
+func deviceUUID(id string) string {
+	idx := strings.LastIndex(id, "-")
+	if idx < 0 {
+		return id
+	}
+	return id[:idx]
+}
+
+// requestUUIDs kubelet为当前容器选择的设备UUID
+func requestUUIDs(reqs *v1beta1.AllocateRequest) []string {
+	var uuids []string
+	for _, req := range reqs.ContainerRequests {
+		for _, id := range req.DevicesIDs {
+			uuids = append(uuids, deviceUUID(id))
+		}
+	}
+	return uuids
+}
+
+// containsDevices 判断kubelet选择的设备是否都在调度器为Pod选择的设备之中
+func containsDevices(podUUIDs, kubeletUUIDs []string) bool {
+	remain := make(map[string]int, len(podUUIDs))
+	for _, uuid := range podUUIDs {
+		remain[uuid]++
+	}
+	for _, uuid := range kubeletUUIDs {
+		if remain[uuid] == 0 {
+			return false
+		}
+		remain[uuid]--
+	}
+	return true
+}
+
+// matchPod 校验kubelet选择的设备与Pod注解中的设备是否一致。
+// 多个Pod同时在当前节点上分配设备时，节点锁对应的Pod不一定是kubelet当前正在分配的Pod，此时在缓存中查找注解能够匹配上的Pod。
+// 找不到能够匹配上的Pod时返回错误，不能把其它Pod的设备和环境变量注入到当前容器中
+func (ps *PluginServer) matchPod(pod *v1.Pod, kubeletUUIDs []string) (*v1.Pod, error) {
+	uuids, err := ps.podUUIDs(pod)
+	if err != nil {
+		return nil, err
+	}
+	if containsDevices(uuids, kubeletUUIDs) {
+		return pod, nil
+	}
+	klog.InfoS("devices chosen by kubelet do not match pod annotation, searching for matching pod",
+		"pod", klog.KObj(pod), "devices", kubeletUUIDs, "annotated", uuids)
+	if ps.informersHaveSynced() {
+		objs, err := ps.cachedAllocatingPods()
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objs {
+			p, ok := obj.(*v1.Pod)
+			if !ok || p.UID == pod.UID || !hami.IsAllocatingPod(p, ps.nodeName) {
+				continue
+			}
+			candidate, err := ps.podUUIDs(p)
+			if err != nil {
+				continue
+			}
+			if containsDevices(candidate, kubeletUUIDs) {
+				klog.InfoS("devices chosen by kubelet match another allocating pod", "pod", klog.KObj(p), "devices", kubeletUUIDs)
+				return p, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("devices %v chosen by kubelet do not match pod %s/%s annotation %v",
+		kubeletUUIDs, pod.Namespace, pod.Name, uuids)
+}
+
+// preferredDevices 优先选择调度器在Pod注解中指定的卡，保证kubelet选择的设备与调度结果一致
+func preferredDevices(req *v1beta1.ContainerPreferredAllocationRequest, podUUIDs []string) []string {
+	size := int(req.AllocationSize)
+	chosen := make(map[string]bool, size)
+	devices := make([]string, 0, size)
+	remain := make(map[string]int, len(podUUIDs))
+	for _, uuid := range podUUIDs {
+		remain[uuid]++
+	}
+	pick := func(id string) {
+		chosen[id] = true
+		devices = append(devices, id)
+		if remain[deviceUUID(id)] > 0 {
+			remain[deviceUUID(id)]--
+		}
+	}
+	for _, id := range req.MustIncludeDeviceIDs {
+		if len(devices) < size && !chosen[id] {
+			pick(id)
+		}
+	}
+	for _, id := range req.AvailableDeviceIDs {
+		if len(devices) < size && !chosen[id] && remain[deviceUUID(id)] > 0 {
+			pick(id)
+		}
+	}
+	for _, id := range req.AvailableDeviceIDs {
+		if len(devices) < size && !chosen[id] {
+			pick(id)
+		}
+	}
+	return devices
+}
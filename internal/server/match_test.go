@@ -0,0 +1,173 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal/hami"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/manager"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestContainsDevices(t *testing.T) {
+	tests := []struct {
+		name    string
+		pod     []string
+		kubelet []string
+		want    bool
+	}{
+		{"same devices", []string{"a", "b"}, []string{"b", "a"}, true},
+		{"subset", []string{"a", "b"}, []string{"a"}, true},
+		{"repeated card", []string{"a", "a"}, []string{"a", "a"}, true},
+		{"card used more times than annotated", []string{"a"}, []string{"a", "a"}, false},
+		{"unknown card", []string{"a"}, []string{"c"}, false},
+		{"empty annotation", nil, []string{"a"}, false},
+		{"nothing requested", []string{"a"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := containsDevices(tt.pod, tt.kubelet); got != tt.want {
+				t.Errorf("containsDevices(%v, %v) = %v, want %v", tt.pod, tt.kubelet, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreferredDevices(t *testing.T) {
+	tests := []struct {
+		name      string
+		available []string
+		must      []string
+		size      int32
+		pod       []string
+		want      []string
+	}{
+		{
+			name:      "prefer annotated cards",
+			available: []string{"a-0", "a-1", "b-0", "b-1"},
+			size:      1,
+			pod:       []string{"b"},
+			want:      []string{"b-0"},
+		},
+		{
+			name:      "one id per annotated use",
+			available: []string{"a-0", "b-0", "b-1", "c-0"},
+			size:      2,
+			pod:       []string{"b", "c"},
+			want:      []string{"b-0", "c-0"},
+		},
+		{
+			name:      "must include comes first",
+			available: []string{"a-0", "b-0"},
+			must:      []string{"a-0"},
+			size:      2,
+			pod:       []string{"b"},
+			want:      []string{"a-0", "b-0"},
+		},
+		{
+			name:      "fill with other devices",
+			available: []string{"a-0", "a-1", "b-0"},
+			size:      2,
+			pod:       []string{"b"},
+			want:      []string{"b-0", "a-0"},
+		},
+		{
+			name:      "pod not found",
+			available: []string{"a-0", "b-0"},
+			size:      1,
+			want:      []string{"a-0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &v1beta1.ContainerPreferredAllocationRequest{
+				AvailableDeviceIDs:   tt.available,
+				MustIncludeDeviceIDs: tt.must,
+				AllocationSize:       tt.size,
+			}
+			if got := preferredDevices(req, tt.pod); !slices.Equal(got, tt.want) {
+				t.Errorf("preferredDevices() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+const testNode = "node1"
+
+func testPod(name, phase, anno string) *v1.Pod {
+	annos := map[string]string{
+		hami.BindTimeAnnotations:     "1",
+		hami.AssignedNodeAnnotations: testNode,
+		hami.DeviceBindPhase:         phase,
+	}
+	if anno != "" {
+		annos["huawei.com/Ascend910B"] = anno
+	}
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID("uid-" + name), Annotations: annos},
+		Status:     v1.PodStatus{Phase: v1.PodPending},
+	}
+}
+
+func TestMatchPod(t *testing.T) {
+	lockHolder := testPod("holder", hami.DeviceBindAllocating, `[{"UUID":"a"}]`)
+	other := testPod("other", hami.DeviceBindAllocating, `[{"UUID":"b"}]`)
+	bound := testPod("bound", hami.DeviceBindSuccess, `[{"UUID":"c"}]`)
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{bindPhaseIndex: bindPhaseIndexFunc})
+	for _, p := range []*v1.Pod{lockHolder, other, bound} {
+		if err := indexer.Add(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ps := &PluginServer{
+		nodeName:        testNode,
+		allocAnno:       "huawei.com/Ascend910B",
+		mgr:             &manager.AscendManager{},
+		podIndexer:      indexer,
+		informersSynced: []cache.InformerSynced{func() bool { return true }},
+	}
+	tests := []struct {
+		name    string
+		pod     *v1.Pod
+		uuids   []string
+		want    string
+		wantErr bool
+	}{
+		{name: "lock holder matches", pod: lockHolder, uuids: []string{"a"}, want: "holder"},
+		{name: "another allocating pod matches", pod: lockHolder, uuids: []string{"b"}, want: "other"},
+		{name: "pods already bound are not searched", pod: lockHolder, uuids: []string{"c"}, wantErr: true},
+		{name: "no pod matches", pod: lockHolder, uuids: []string{"x"}, wantErr: true},
+		{name: "lock holder without annotation", pod: testPod("empty", hami.DeviceBindAllocating, ""), uuids: []string{"a"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ps.matchPod(tt.pod, tt.uuids)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("matchPod() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.Name != tt.want {
+				t.Errorf("matchPod() = %s, want %s", got.Name, tt.want)
+			}
+		})
+	}
+}
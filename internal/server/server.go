@@ -18,45 +18,82 @@ package server
 
 import (
 	"context"
-	"flag"
 	"fmt"
 	"net"
 	"os"
 	"path"
+	"slices"
+	"sync"
 	"time"
 
-	"github.com/Project-HAMi/HAMi/pkg/device/ascend"
-	"github.com/Project-HAMi/HAMi/pkg/util"
-	"github.com/Project-HAMi/HAMi/pkg/util/nodelock"
+	"github.com/Project-HAMi/ascend-device-plugin/internal"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/audit"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/hami"
 	"github.com/Project-HAMi/ascend-device-plugin/internal/manager"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	listerv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
-const (
-	// RegisterAnnos = "hami.io/node-register-ascend"
-	// PodAllocAnno = "huawei.com/AscendDevices"
-	NodeLockAscend = "hami.io/mutex.lock"
-)
-
-var (
-	reportTimeOffset = flag.Int64("report_time_offset", 1, "report time offset")
-)
-
 type PluginServer struct {
 	nodeName      string // 当前所在的节点名
 	registerAnno  string // 注册到节点上的设备，volcano从这个注解上获取设备信息
 	handshakeAnno string // 握手信息
 	allocAnno     string // 给Pod分配设备之后，使用的注解
+	allocatedAnno string // 调度器记录每个容器分配到的设备的注解
+	// 每次Start时重新创建，停止之后的grpc.Server不能再次使用
 	grpcServer    *grpc.Server
 	mgr           *manager.AscendManager
+	client        kubernetes.Interface   // 访问API Server，只用来生成注解的inspect中为空
+	runtime       internal.RuntimeConfig // 各种时间间隔和超时时间
+	lastRegister  string                 // 上一次成功写入节点的设备注解
+	lastHandshake time.Time              // 上一次成功写入握手注解的时间
 	socket        string
 	stopCh        chan interface{}
 	healthCh      chan int32
+	registerCh    chan struct{} // 收到调度器的握手请求之后，通知注册协程立即上报
+	handshakeMu   sync.Mutex
+	deletedAt     time.Time        // 调度器写入Deleted_的时间，在此之后的outOfServicePeriod时间内设备不对外提供服务
+	now           func() time.Time // 当前时间，测试中替换
+	// 当前节点以及当前节点上Pod的本地缓存。重启时startInformers会重新设置，
+	// 而调试接口在整个进程中都可能读取，因此通过informerMu访问，见informer.go
+	informerMu      sync.RWMutex
+	nodeLister      listerv1.NodeLister
+	podLister       listerv1.PodLister
+	podIndexer      cache.Indexer
+	informersSynced []cache.InformerSynced
+	recorder        record.EventRecorder // 设备健康状态发生变化时在节点上记录Event
+	// 当前节点上每个容器使用的卡，见containers.go
+	containers containerDevices
+	// 调试接口使用的状态，见debug.go
+	debug debugState
+	// 分配结果的审计日志，为空时不写
+	audit *audit.Logger
+	// 是否定期采集硬件遥测数据，只在开启了metrics服务时采集
+	telemetry bool
+	// dry run模式下不向kubelet注册，所有对节点的修改以及节点锁的释放都只打印日志
+	dryRun bool
+	// 正在进行的Allocate以及后台协程，停止时等待它们结束。等待可能超时，
+	// 超时之后旧的WaitGroup上可能还有协程在Wait，因此每次Start都重新创建
+	allocating *sync.WaitGroup
+	loops      *sync.WaitGroup
+	// drain开始之后不再接受新的Allocate。allocating.Add也在drainMu中调用，保证不会与drain中的Wait并发
+	drainMu  sync.Mutex
+	draining bool
+	// 自动污点的状态，只在健康检查协程中访问
+	taintInitialized bool
+	tainted          bool
+	recoveredSince   time.Time
 }
 
 /*
@@ -72,28 +109,52 @@ type PluginServer struct {
 {"index":7,"id":"Ascend910B-7","count":4,"devmem":65536,"devcore":20,"type":"Ascend910B","health":true}]'
 */
 
-func NewPluginServer(mgr *manager.AscendManager, nodeName string) (*PluginServer, error) {
+func NewPluginServer(mgr *manager.AscendManager, client kubernetes.Interface, nodeName string, runtime internal.RuntimeConfig, dryRun bool) (*PluginServer, error) {
+	runtime.SetDefaults()
+	socket := fmt.Sprintf("%s.sock", mgr.CommonWord())
+	if dryRun {
+		// 和正在运行的插件使用不同的socket，避免删除正在运行的插件的socket
+		socket = fmt.Sprintf("%s-dry-run.sock", mgr.CommonWord())
+	}
 	return &PluginServer{
 		nodeName:      nodeName,
 		registerAnno:  fmt.Sprintf("hami.io/node-register-%s", mgr.CommonWord()),
 		handshakeAnno: fmt.Sprintf("hami.io/node-handshake-%s", mgr.CommonWord()),
 		allocAnno:     fmt.Sprintf("huawei.com/%s", mgr.CommonWord()),
-		grpcServer:    grpc.NewServer(),
+		allocatedAnno: fmt.Sprintf("hami.io/%s-devices-allocated", mgr.CommonWord()),
 		mgr:           mgr,
+		client:        client,
+		runtime:       runtime,
 		// TODO 这里只上报了一种类型的资源， 为什么不考虑整卡资源和虚卡资源分开上报？
-		socket:   path.Join(v1beta1.DevicePluginPath, fmt.Sprintf("%s.sock", mgr.CommonWord())),
-		stopCh:   make(chan interface{}),
-		healthCh: make(chan int32),
+		socket:     path.Join(v1beta1.DevicePluginPath, socket),
+		stopCh:     make(chan interface{}),
+		healthCh:   make(chan int32, 1),
+		registerCh: make(chan struct{}, 1),
+		recorder:   newEventRecorder(client, dryRun),
+		dryRun:     dryRun,
+		now:        time.Now,
 	}, nil
 }
 
 func (ps *PluginServer) Start() error {
 	ps.stopCh = make(chan interface{})
+	ps.drainMu.Lock()
+	ps.allocating = &sync.WaitGroup{}
+	ps.draining = false
+	ps.drainMu.Unlock()
+	ps.loops = &sync.WaitGroup{}
+	// 重启之后强制重新注册一次
+	ps.lastRegister = ""
 	// 通过查询驱动获取当前节点所有芯片的信息，包括物理ID、逻辑ID、UUID、内存、AI核心，健康状态等信息
 	err := ps.mgr.UpdateDevice()
 	if err != nil {
 		return err
 	}
+	// 监听当前节点（调度器写入的握手信息以及节点锁）以及当前节点上的Pod，Allocate时直接从本地缓存中查找Pod
+	err = ps.startInformers()
+	if err != nil {
+		return err
+	}
 	// 1. 启动DP，并等待DP启动成功
 	// 2. 移除之前注册的socket文件，然后重新启动GRPC服务，此时会重新创建socket文件
 	err = ps.serve()
@@ -101,21 +162,53 @@ func (ps *PluginServer) Start() error {
 		return err
 	}
 	// 注册kubelet
-	err = ps.registerKubelet()
-	if err != nil {
+	if ps.dryRun {
+		klog.InfoS("dry run: skip registering to kubelet", "resource", ps.mgr.ResourceName(), "socket", ps.socket)
+	} else if err = ps.registerKubelet(); err != nil {
 		return err
 	}
-	// 定时获取设备的健康状态，上报到Kubelet。与此同时定期更新节点的注解【设备】信息以及握手信息
-	go ps.watchAndRegister()
+	// 定时获取设备的健康状态，上报到Kubelet
+	ps.goLoop(ps.watchHealth)
+	// 定期更新节点的注解【设备】信息以及握手信息
+	ps.goLoop(ps.watchAndRegister)
+	// 定期采集硬件遥测数据
+	if ps.telemetry {
+		ps.goLoop(ps.watchTelemetry)
+	}
 	return nil
 }
 
+// Stop 停止GRPC服务以及后台协程，正在进行的Allocate最多等待shutdownGracePeriod，并删除socket文件。
+// 重启时也会调用，之后可以再次Start
 func (ps *PluginServer) Stop() error {
 	close(ps.stopCh)
-	ps.grpcServer.Stop()
+	if ps.grpcServer != nil {
+		ps.drain()
+	}
+	if !waitTimeout(ps.loops, ps.runtime.ShutdownGracePeriod.Duration) {
+		klog.InfoS("background loops did not stop in grace period", "gracePeriod", ps.runtime.ShutdownGracePeriod.Duration)
+	}
+	// 关闭监听时socket文件一般已经被删除，这里保证异常情况下也不会残留，避免kubelet连接到已经退出的插件
+	if err := os.Remove(ps.socket); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove socket %s error: %v", ps.socket, err)
+	}
 	return nil
 }
 
+// SetAuditLogger 设置写入分配结果的审计日志，需要在Start之前调用
+func (ps *PluginServer) SetAuditLogger(l *audit.Logger) {
+	ps.audit = l
+}
+
+// ConfigChanged 配置更新之后重新获取设备信息，并尽快上报给kubelet和调度器
+func (ps *PluginServer) ConfigChanged() {
+	if err := ps.mgr.UpdateDevice(); err != nil {
+		klog.ErrorS(err, "failed to update devices after config changed")
+	}
+	ps.notifyKubelet()
+	ps.requestRegister()
+}
+
 func (ps *PluginServer) dial(unixSocketPath string, timeout time.Duration) (*grpc.ClientConn, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
@@ -143,7 +236,9 @@ func (ps *PluginServer) serve() error {
 		return err
 	}
 	// 驱动GRPC服务之前，注册GRPC的服务，有点类似于注册路由的感觉
-	v1beta1.RegisterDevicePluginServer(ps.grpcServer, ps)
+	grpcServer := grpc.NewServer()
+	ps.grpcServer = grpcServer
+	v1beta1.RegisterDevicePluginServer(grpcServer, ps)
 	// 获取当前的资源名，譬如huawei.com/Ascend910A， huawei.com/Ascend910B等等
 	resourceName := ps.mgr.ResourceName()
 	go func() {
@@ -152,7 +247,7 @@ func (ps *PluginServer) serve() error {
 		for {
 			klog.Infof("Starting GRPC server for '%s'", resourceName)
 			// 启动GRPC服务，GRPC服务，必须要在注册kubelet之前就启动，否则一会kubelet回调ListAndWatch方法的时候,会调用失败
-			err := ps.grpcServer.Serve(sock)
+			err := grpcServer.Serve(sock)
 			if err == nil {
 				break
 			}
@@ -179,7 +274,7 @@ func (ps *PluginServer) serve() error {
 
 	// Wait for server to start by launching a blocking connexion
 	// 等待GRPC服务启动完成
-	conn, err := ps.dial(ps.socket, 5*time.Second)
+	conn, err := ps.dial(ps.socket, ps.runtime.DialTimeout.Duration)
 	if err != nil {
 		return err
 	}
@@ -189,7 +284,7 @@ func (ps *PluginServer) serve() error {
 }
 
 func (ps *PluginServer) registerKubelet() error {
-	conn, err := ps.dial(v1beta1.KubeletSocket, 5*time.Second)
+	conn, err := ps.dial(v1beta1.KubeletSocket, ps.runtime.DialTimeout.Duration)
 	if err != nil {
 		return err
 	}
@@ -202,7 +297,7 @@ func (ps *PluginServer) registerKubelet() error {
 		Endpoint:     path.Base(ps.socket),
 		ResourceName: ps.mgr.ResourceName(),
 		Options: &v1beta1.DevicePluginOptions{
-			GetPreferredAllocationAvailable: false,
+			GetPreferredAllocationAvailable: true,
 		},
 	}
 
@@ -213,83 +308,206 @@ func (ps *PluginServer) registerKubelet() error {
 	return nil
 }
 
-// 所谓注册HAMI其实就是给节点打上hami相关的注解
-func (ps *PluginServer) registerHAMi() error {
-	// 获取所有的设备
+// registerDevice 在HAMi的DeviceInfo之上追加驱动中已经存在的vNPU的使用情况，HAMi解析注解时会忽略这些字段
+type registerDevice struct {
+	hami.DeviceInfo
+	UsedMem   int32 `json:"usedmem,omitempty"`
+	UsedCores int32 `json:"usedcores,omitempty"`
+	VNPUs     int   `json:"vnpus,omitempty"`
+	// 健康状态频繁变化而被隔离的卡
+	Quarantined bool `json:"quarantined,omitempty"`
+	// 手动停止对外提供服务的卡
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// 残留的vNPU（没有被任何容器使用）并不在HAMi的账本中，因此需要从上报的容量中扣除，避免HAMi超额调度。
+// 正在被容器使用的vNPU已经被HAMi记账，这里只做展示，不再重复扣除
+func (ps *PluginServer) registerDevices() []*registerDevice {
 	devs := ps.mgr.GetDevices()
-	apiDevices := make([]*util.DeviceInfo, 0, len(devs))
+	vCount := int32(ps.mgr.VDeviceCount())
+	apiDevices := make([]*registerDevice, 0, len(devs))
 	// hami currently believes that the index starts from 0 and is continuous.
 	for i, dev := range devs {
-		apiDevices = append(apiDevices, &util.DeviceInfo{
-			Index:   uint(i),
-			ID:      dev.UUID,
-			Count:   int32(ps.mgr.VDeviceCount()), // 昇腾的算力切分，本质上就是应用昇腾的模板，因此这里最多可以创建的虚卡数量为可分配内存处于最小模板需要使用的内存大小
-			Devmem:  int32(dev.Memory),
-			Devcore: dev.AICore,
-			Type:    ps.mgr.CommonWord(),
-			Numa:    0,
-			Health:  dev.Health,
+		count, devmem, devcore := vCount, int32(dev.Memory), dev.AICore
+		disabled := ps.mgr.IsDisabled(dev)
+		for _, v := range dev.LeftoverVNPUs() {
+			count--
+			devmem -= int32(v.Memory)
+			devcore -= v.AICore
+		}
+		apiDevices = append(apiDevices, &registerDevice{
+			DeviceInfo: hami.DeviceInfo{
+				Index:   uint(i),
+				ID:      dev.UUID,
+				Count:   max(count, 0), // 昇腾的算力切分，本质上就是应用昇腾的模板，因此这里最多可以创建的虚卡数量为可分配内存处于最小模板需要使用的内存大小
+				Devmem:  max(devmem, 0),
+				Devcore: max(devcore, 0),
+				Type:    ps.mgr.CommonWord(),
+				Numa:    0,
+				Health:  dev.Health && !disabled,
+			},
+			UsedMem:     int32(dev.UsedMemory),
+			UsedCores:   dev.UsedAICore,
+			VNPUs:       len(dev.VNPUs),
+			Quarantined: dev.Quarantined,
+			Disabled:    disabled,
 		})
 	}
+	return apiDevices
+}
+
+// RegisterAnnotation 返回当前会写入节点的设备注解，不会修改节点
+func (ps *PluginServer) RegisterAnnotation() (string, string, error) {
+	data, err := json.Marshal(ps.registerDevices())
+	if err != nil {
+		return "", "", fmt.Errorf("marshal register devices error: %v", err)
+	}
+	return ps.registerAnno, string(data), nil
+}
+
+// logAnnotationsDiff dry run模式下打印将要写入的注解与节点上当前注解的差异，节点上当前的注解一般是正在运行的插件写入的
+func (ps *PluginServer) logAnnotationsDiff(annos map[string]string) {
+	current := map[string]string{}
+	if node, err := ps.cachedNode(); err == nil {
+		current = node.Annotations
+	} else {
+		klog.InfoS("dry run: get node from cache failed", "err", err)
+	}
+	for key, value := range annos {
+		old, ok := current[key]
+		switch {
+		case !ok:
+			klog.InfoS("dry run: would add annotation", "annotation", key, "value", value)
+		case old == value:
+			klog.InfoS("dry run: annotation unchanged", "annotation", key)
+		default:
+			klog.InfoS("dry run: would change annotation", "annotation", key, "from", old, "to", value)
+		}
+	}
+}
+
+// 所谓注册HAMI其实就是给节点打上hami相关的注解。
+// 设备信息没有变化并且还没到刷新握手信息的时间时，不再更新节点，减少对API Server的压力
+func (ps *PluginServer) registerHAMi(force bool) (err error) {
+	ctx, span := tracing.Start(context.Background(), "registerHAMi", attribute.Bool("force", force))
+	defer func() { tracing.End(span, err) }()
+	if ps.outOfService() {
+		klog.V(5).InfoS("devices are out of service, skip registering")
+		return nil
+	}
+	_, register, err := ps.RegisterAnnotation()
+	if err != nil {
+		return err
+	}
+	now := ps.now()
+	if !force && register == ps.lastRegister && now.Sub(ps.lastHandshake) < ps.runtime.HandshakeInterval.Duration {
+		klog.V(5).InfoS("devices not changed, skip patching annotations")
+		return nil
+	}
 	annos := make(map[string]string)
 	// 向节点注册设备信息
-	annos[ps.registerAnno] = util.MarshalNodeDevices(apiDevices)
+	annos[ps.registerAnno] = register
 	// 向节点更新握手信息
-	annos[ps.handshakeAnno] = "Reported_" + time.Now().Add(time.Duration(*reportTimeOffset)*time.Second).Format("2006.01.02 15:04:05")
-	node, err := util.GetNode(ps.nodeName)
-	if err != nil {
-		return fmt.Errorf("get node %s error: %v", ps.nodeName, err)
+	annos[ps.handshakeAnno] = "Reported_" + now.Add(ps.runtime.ReportTimeOffset.Duration).Format("2006.01.02 15:04:05")
+	if ps.dryRun {
+		ps.logAnnotationsDiff(annos)
+		ps.lastRegister = register
+		ps.lastHandshake = now
+		ps.debug.setPublished(annos[ps.registerAnno], annos[ps.handshakeAnno], now)
+		return nil
 	}
-	err = util.PatchNodeAnnotations(node, annos)
+	patchCtx, patchSpan := tracing.Start(ctx, "patchNodeAnnotations")
+	err = hami.PatchNodeAnnotations(patchCtx, ps.client, ps.nodeName, annos)
+	tracing.End(patchSpan, err)
 	if err != nil {
+		ps.lastRegister = ""
 		return fmt.Errorf("patch node %s annotations error: %v", ps.nodeName, err)
 	}
-	klog.V(5).Infof("patch node %s annotations: %v", ps.nodeName, annos)
+	ps.lastRegister = register
+	ps.lastHandshake = now
+	ps.debug.setPublished(annos[ps.registerAnno], annos[ps.handshakeAnno], now)
+	klog.V(5).InfoS("patched node annotations", "annotations", annos)
 	return nil
 }
 
-// 定时获取设备的健康状态，上报到Kubelet。与此同时定期更新节点的注解【设备】信息以及握手信息
+// 定时获取设备的健康状态，只有不健康的设备发生变化时才重新查询设备信息并通知Kubelet
+// 健康状态发生变化时在节点上记录Event，并更新节点上的AscendNPUHealthy Condition
+func (ps *PluginServer) watchHealth() {
+	var lastUnhealthy []int32
+	initialized := false
+	ticker := time.NewTicker(ps.runtime.HealthCheckInterval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ps.stopCh:
+			klog.InfoS("stop watch health")
+			return
+		case <-ticker.C:
+		}
+		unhealthy := ps.mgr.GetUnHealthIDs()
+		// 污点需要根据持续时间判断是否移除，因此每次健康检查都需要处理
+		ps.updateTaint(len(unhealthy))
+		if initialized && slices.Equal(unhealthy, lastUnhealthy) {
+			continue
+		}
+		if err := ps.mgr.UpdateDevice(); err != nil {
+			klog.ErrorS(err, "failed to update devices")
+			continue
+		}
+		klog.InfoS("unhealthy devices changed", "from", lastUnhealthy, "to", unhealthy)
+		ps.reportHealth(lastUnhealthy, unhealthy)
+		lastUnhealthy = unhealthy
+		initialized = true
+		ps.notifyKubelet()
+	}
+}
+
+// 定期更新节点的注解【设备】信息以及握手信息，失败时按照errorBackoff加上随机抖动重试
 func (ps *PluginServer) watchAndRegister() {
 	timer := time.After(1 * time.Second)
 	for {
+		force := false
 		select {
 		case <-ps.stopCh:
-			klog.Infof("stop watch and register")
+			klog.InfoS("stop watch and register")
 			return
 		case <-timer:
+		case <-ps.registerCh:
+			force = true
 		}
-		unhealthy := ps.mgr.GetUnHealthIDs()
-		if len(unhealthy) > 0 {
-			if err := ps.mgr.UpdateDevice(); err != nil {
-				klog.Errorf("update device error: %v", err)
-				timer = time.After(5 * time.Second)
-				continue
-			}
-			ps.healthCh <- unhealthy[0]
+		// 停止服务的时间到了之后重新向kubelet和调度器上报设备
+		if ps.backInService() {
+			klog.InfoS("devices back in service")
+			ps.notifyKubelet()
+			force = true
 		}
+		// 崩溃之后残留的vNPU会一直占用卡上的资源，每次注册之前都重新查询一次
+		ps.mgr.UpdateVNPUs()
 		// 所谓注册HAMI其实就是给节点打上hami相关的注解，一个是更新节点设备信息，一个是更新握手信息
-		err := ps.registerHAMi()
+		err := ps.registerHAMi(force)
 		if err != nil {
-			klog.Errorf("register HAMi error: %v", err)
-			timer = time.After(5 * time.Second)
+			klog.ErrorS(err, "failed to register HAMi")
+			backoff := ps.runtime.ErrorBackoff.Duration
+			// wait.Jitter把0当作1.0，配置为0时不加抖动
+			if jitter := *ps.runtime.ErrorBackoffJitter; jitter > 0 {
+				backoff = wait.Jitter(backoff, jitter)
+			}
+			timer = time.After(backoff)
 		} else {
-			klog.V(3).Infof("register HAMi success")
-			timer = time.After(30 * time.Second)
+			klog.V(3).InfoS("register HAMi success")
+			timer = time.After(ps.runtime.RegisterInterval.Duration)
 		}
 	}
 }
 
 // 调度器调度完成之后，会把分配的设备写入到Pod注解中，这里在解析注解信息获取当前Pod分配到的设备以及对应的模板
-func (ps *PluginServer) parsePodAnnotation(pod *v1.Pod) ([]int32, []string, error) {
+func (ps *PluginServer) parsePodAnnotation(ctx context.Context, pod *v1.Pod) (_ []int32, _ []string, err error) {
+	_, span := tracing.Start(ctx, "parsePodAnnotation")
+	defer func() { tracing.End(span, err) }()
 	// 从调度其中获取当前分配的卡和模板
-	anno, ok := pod.Annotations[ps.allocAnno]
-	if !ok {
-		return nil, nil, fmt.Errorf("annotation %s not set", "huawei.com/Ascend")
-	}
-	var rtInfo []ascend.RuntimeInfo
-	err := json.Unmarshal([]byte(anno), &rtInfo)
+	rtInfo, err := ps.podRuntimeInfo(pod)
 	if err != nil {
-		return nil, nil, fmt.Errorf("annotation %s value %s invalid", ps.allocAnno, anno)
+		return nil, nil, err
 	}
 	var IDs []int32
 	var temps []string
@@ -306,18 +524,25 @@ func (ps *PluginServer) parsePodAnnotation(pod *v1.Pod) ([]int32, []string, erro
 		temps = append(temps, info.Temp)
 	}
 	if len(IDs) == 0 {
-		return nil, nil, fmt.Errorf("annotation %s value %s invalid", ps.allocAnno, anno)
+		return nil, nil, fmt.Errorf("annotation %s value %s invalid", ps.allocAnno, pod.Annotations[ps.allocAnno])
 	}
 	return IDs, temps, nil
 }
 
+// KubeletDevices 返回当前会通过ListAndWatch上报给kubelet的设备列表
+func (ps *PluginServer) KubeletDevices() []*v1beta1.Device {
+	return ps.apiDevices()
+}
+
 func (ps *PluginServer) apiDevices() []*v1beta1.Device {
 	devs := ps.mgr.GetDevices()
 	devices := make([]*v1beta1.Device, 0, len(devs))
 	vCount := ps.mgr.VDeviceCount()
+	// 调度器已经移除了当前节点的设备，此时设备不再对外提供服务
+	outOfService := ps.outOfService()
 	for _, dev := range devs {
 		health := v1beta1.Unhealthy
-		if dev.Health {
+		if dev.Health && !outOfService && !ps.mgr.IsDisabled(dev) {
 			health = v1beta1.Healthy
 		}
 		// TODO 这里会不会有问题，因为一张卡可能不是等分的，有可能是多种规格的组合
@@ -330,12 +555,12 @@ func (ps *PluginServer) apiDevices() []*v1beta1.Device {
 			devices = append(devices, &device)
 		}
 	}
-	klog.V(5).Infof("api devices: %v", devices)
+	klog.V(5).InfoS("api devices", "devices", devices)
 	return devices
 }
 
 func (ps *PluginServer) GetDevicePluginOptions(context.Context, *v1beta1.Empty) (*v1beta1.DevicePluginOptions, error) {
-	return &v1beta1.DevicePluginOptions{}, nil
+	return &v1beta1.DevicePluginOptions{GetPreferredAllocationAvailable: true}, nil
 }
 
 func (ps *PluginServer) ListAndWatch(e *v1beta1.Empty, s v1beta1.DevicePlugin_ListAndWatchServer) error {
@@ -351,38 +576,103 @@ func (ps *PluginServer) ListAndWatch(e *v1beta1.Empty, s v1beta1.DevicePlugin_Li
 	}
 }
 
-func (ps *PluginServer) GetPreferredAllocation(context.Context, *v1beta1.PreferredAllocationRequest) (*v1beta1.PreferredAllocationResponse, error) {
-	return nil, fmt.Errorf("not supported")
+// GetPreferredAllocation kubelet上报的设备ID与真实的卡无关，这里让kubelet优先选择调度器为Pod选择的卡，Allocate时再校验两者是否一致。
+// 找不到Pod时不返回错误，否则kubelet会直接分配失败
+func (ps *PluginServer) GetPreferredAllocation(ctx context.Context, reqs *v1beta1.PreferredAllocationRequest) (*v1beta1.PreferredAllocationResponse, error) {
+	var uuids []string
+	pod, err := ps.getPendingPod(ctx)
+	if err != nil {
+		klog.InfoS("get pending pod for preferred allocation failed", "err", err)
+	} else if uuids, err = ps.podUUIDs(pod); err != nil {
+		klog.InfoS("get devices of pod for preferred allocation failed", "pod", klog.KObj(pod), "err", err)
+	}
+	resp := &v1beta1.PreferredAllocationResponse{}
+	for _, req := range reqs.ContainerRequests {
+		resp.ContainerResponses = append(resp.ContainerResponses, &v1beta1.ContainerPreferredAllocationResponse{
+			DeviceIDs: preferredDevices(req, uuids),
+		})
+	}
+	klog.V(5).InfoS("preferred allocation", "response", resp)
+	return resp, nil
 }
 
-func (ps *PluginServer) Allocate(ctx context.Context, reqs *v1beta1.AllocateRequest) (*v1beta1.AllocateResponse, error) {
-	klog.V(5).Infof("Allocate: %v", reqs)
+func (ps *PluginServer) Allocate(ctx context.Context, reqs *v1beta1.AllocateRequest) (_ *v1beta1.AllocateResponse, err error) {
+	// 重启时Start会替换ps.allocating，这里使用开始时的WaitGroup
+	allocating, ok := ps.beginAllocate()
+	if !ok {
+		return nil, fmt.Errorf("device plugin of node %s is shutting down", ps.nodeName)
+	}
+	defer allocating.Done()
+	// 每一次分配的结果都写入审计日志，同时保留最近的结果供调试接口查看
+	record := audit.Record{Time: time.Now(), Node: ps.nodeName, DeviceIDs: requestDeviceIDs(reqs), Outcome: audit.OutcomeSuccess}
+	// 这次分配相关的日志都带上kubelet选择的设备，找到Pod之后再带上Pod
+	ctx, span := tracing.Start(ctx, "Allocate", attribute.StringSlice("devices", record.DeviceIDs))
+	base := klog.FromContext(ctx).WithValues("devices", record.DeviceIDs)
+	logger := base
+	logger.V(5).Info("Allocate", "request", reqs)
+	defer func() {
+		record.DurationMs = float64(time.Since(record.Time).Microseconds()) / 1000
+		if err != nil {
+			record.Outcome = audit.OutcomeFailure
+			record.Error = err.Error()
+		}
+		if record.Pod != nil {
+			span.SetAttributes(attribute.String("pod", record.Pod.Namespace+"/"+record.Pod.Name))
+		}
+		tracing.End(span, err)
+		ps.debug.addAllocation(record)
+		if ps.audit != nil {
+			if werr := ps.audit.Write(&record); werr != nil {
+				logger.Error(werr, "write allocation audit log failed")
+			}
+		}
+	}()
+	// 插件退出时被取消的Allocate，kubelet已经收不到结果，按照分配失败释放节点锁，让调度器重新调度。
+	// 每一步之后都检查一次，取消之后不再继续分配，审计日志中也记录为失败
+	abort := func(pod *v1.Pod) error {
+		logger.Error(ctx.Err(), "allocate aborted")
+		ps.releaseNodeLock(ctx, pod, false)
+		return fmt.Errorf("allocate aborted: %v", ctx.Err())
+	}
 	// 通过节点锁获取当前节点处于Pending的Pod，volcano调度之后会给当前节点设置一把锁，锁信息中会包含当前需要分配设备的Pod信息 ns/name
-	pod, err := util.GetPendingPod(ctx, ps.nodeName)
+	pod, err := ps.getPendingPod(ctx)
 	if err != nil {
-		klog.Errorf("get pending pod error: %v", err)
+		logger.Error(err, "get pending pod failed")
 		// 分配失败，直接释放锁
-		lockerr := nodelock.ReleaseNodeLock(ps.nodeName, NodeLockAscend, pod, false)
-		if lockerr != nil {
-			klog.Errorf("failed to release lock:%s", err.Error())
-		}
+		ps.releaseNodeLock(ctx, pod, false)
 		return nil, fmt.Errorf("get pending pod error: %v", err)
 	}
+	record.Pod = podRef(pod)
+	logger = base.WithValues("pod", klog.KObj(pod))
+	if ctx.Err() != nil {
+		return nil, abort(pod)
+	}
+	// 校验kubelet选择的设备与调度器写入Pod注解中的设备是否一致，避免多个Pod同时分配时用错了Pod的注解
+	matched, err := ps.matchPod(pod, requestUUIDs(reqs))
+	if err != nil {
+		logger.Error(err, "match pod failed")
+		ps.releaseNodeLock(ctx, pod, false)
+		return nil, fmt.Errorf("match pod error: %v", err)
+	}
+	// 匹配上的不是节点锁对应的Pod时，节点锁不一定属于这个Pod，只能在锁属于这个Pod时释放
+	lockHolder := matched.UID == pod.UID
+	pod = matched
+	logger = base.WithValues("pod", klog.KObj(pod))
+	record.Pod = podRef(pod)
+	record.RuntimeInfo, _ = ps.podRuntimeInfo(pod)
 	resp := v1beta1.ContainerAllocateResponse{}
 	// 调度器调度完成之后，会把分配的设备写入到Pod注解中，这里在解析注解信息获取当前Pod分配到的设备以及对应的模板
-	IDs, temps, err := ps.parsePodAnnotation(pod)
+	IDs, temps, err := ps.parsePodAnnotation(ctx, pod)
 	if err != nil {
-		lockerr := nodelock.ReleaseNodeLock(ps.nodeName, NodeLockAscend, pod, false)
-		if lockerr != nil {
-			klog.Errorf("failed to release lock:%s", err.Error())
-		}
+		logger.Error(err, "parse pod annotation failed")
+		ps.releaseNodeLock(ctx, pod, false)
 		return nil, fmt.Errorf("parse pod annotation error: %v", err)
 	}
+	if ctx.Err() != nil {
+		return nil, abort(pod)
+	}
 	if len(IDs) == 0 {
-		lockerr := nodelock.ReleaseNodeLock(ps.nodeName, NodeLockAscend, pod, false)
-		if lockerr != nil {
-			klog.Errorf("failed to release lock:%s", err.Error())
-		}
+		ps.releaseNodeLock(ctx, pod, false)
 		return nil, fmt.Errorf("empty id from pod annotation")
 	}
 	ascendVisibleDevices := fmt.Sprintf("%d", IDs[0])
@@ -404,14 +694,51 @@ func (ps *PluginServer) Allocate(ctx context.Context, reqs *v1beta1.AllocateRequ
 	if ascendVNPUSpec != "" {
 		resp.Envs["ASCEND_VNPU_SPECS"] = ascendVNPUSpec
 	}
-	klog.V(5).Infof("allocate response: %v", resp)
-	lockerr := nodelock.ReleaseNodeLock(ps.nodeName, NodeLockAscend, pod, true)
-	if lockerr != nil {
-		klog.Errorf("failed to release lock:%s", err.Error())
+	record.PhyIDs = IDs
+	record.Template = ascendVNPUSpec
+	record.Envs = resp.Envs
+	logger.V(5).Info("allocate response", "envs", resp.Envs)
+	// 释放节点锁之前是最后一个能让调度器知道分配失败的位置
+	if ctx.Err() != nil {
+		return nil, abort(pod)
 	}
+	ps.releaseNodeLock(ctx, pod, lockHolder)
 	return &v1beta1.AllocateResponse{ContainerResponses: []*v1beta1.ContainerAllocateResponse{&resp}}, nil
 }
 
+func requestDeviceIDs(reqs *v1beta1.AllocateRequest) []string {
+	var ids []string
+	for _, req := range reqs.ContainerRequests {
+		ids = append(ids, req.DevicesIDs...)
+	}
+	return ids
+}
+
+func podRef(pod *v1.Pod) *audit.PodRef {
+	return &audit.PodRef{Namespace: pod.Namespace, Name: pod.Name, UID: string(pod.UID)}
+}
+
+// releaseNodeLock 释放调度器加在当前节点上的锁，dry run模式下只打印日志。
+// force为false时只有锁属于这个Pod才会释放，为true时不检查直接释放，只能用于节点锁对应的Pod。
+// Allocate被取消之后也要释放节点锁，因此不使用ctx的取消
+func (ps *PluginServer) releaseNodeLock(ctx context.Context, pod *v1.Pod, force bool) {
+	var err error
+	ctx, span := tracing.Start(context.WithoutCancel(ctx), "releaseNodeLock", attribute.Bool("force", force))
+	defer func() { tracing.End(span, err) }()
+	// 找不到Pod时无法判断锁属于谁，由调度器在锁超时之后释放
+	if pod == nil {
+		klog.InfoS("no pod found, leave node lock to expire")
+		return
+	}
+	if ps.dryRun {
+		klog.InfoS("dry run: skip releasing node lock", "pod", klog.KObj(pod), "force", force)
+		return
+	}
+	if err = hami.ReleaseNodeLock(ctx, ps.client, ps.nodeName, pod, force); err != nil {
+		klog.ErrorS(err, "failed to release node lock", "pod", klog.KObj(pod))
+	}
+}
+
 func (ps *PluginServer) PreStartContainer(context.Context, *v1beta1.PreStartContainerRequest) (*v1beta1.PreStartContainerResponse, error) {
 	return &v1beta1.PreStartContainerResponse{}, nil
 }
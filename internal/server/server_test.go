@@ -0,0 +1,122 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/manager"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func countPatches(client *fake.Clientset) int {
+	n := 0
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "patch" && action.GetResource().Resource == "nodes" {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRegisterHAMi(t *testing.T) {
+	const interval = 30 * time.Second
+	start := time.Now()
+	tests := []struct {
+		name         string
+		lastRegister string // 为空时使用当前的设备注解，即设备信息没有变化
+		handshakeAge time.Duration
+		force        bool
+		deleted      bool
+		wantPatch    bool
+	}{
+		{name: "unchanged payload and handshake not due", handshakeAge: interval - time.Second},
+		{name: "unchanged payload and handshake due", handshakeAge: interval, wantPatch: true},
+		{name: "forced by scheduler request", handshakeAge: time.Second, force: true, wantPatch: true},
+		{name: "payload changed", lastRegister: `[{"id":"old"}]`, handshakeAge: time.Second, wantPatch: true},
+		{name: "out of service", handshakeAge: interval, force: true, deleted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := start
+			client := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNode}})
+			ps := &PluginServer{
+				nodeName:      testNode,
+				registerAnno:  "hami.io/node-register-Ascend910B",
+				handshakeAnno: "hami.io/node-handshake-Ascend910B",
+				mgr:           &manager.AscendManager{},
+				client:        client,
+				runtime: internal.RuntimeConfig{
+					HandshakeInterval:  metav1.Duration{Duration: interval},
+					OutOfServicePeriod: metav1.Duration{Duration: interval},
+					ReportTimeOffset:   &metav1.Duration{},
+				},
+				now: func() time.Time { return now },
+			}
+			_, register, err := ps.RegisterAnnotation()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ps.lastRegister = register
+			if tt.lastRegister != "" {
+				ps.lastRegister = tt.lastRegister
+			}
+			ps.lastHandshake = now.Add(-tt.handshakeAge)
+			if tt.deleted {
+				ps.deletedAt = now
+			}
+
+			if err := ps.registerHAMi(tt.force); err != nil {
+				t.Fatalf("registerHAMi() error = %v", err)
+			}
+			if patched := countPatches(client) > 0; patched != tt.wantPatch {
+				t.Fatalf("registerHAMi() patched node = %v, want %v", patched, tt.wantPatch)
+			}
+			if !tt.wantPatch {
+				return
+			}
+			node, err := client.CoreV1().Nodes().Get(context.Background(), testNode, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := node.Annotations[ps.registerAnno]; got != register {
+				t.Errorf("register annotation = %s, want %s", got, register)
+			}
+			if got := node.Annotations[ps.handshakeAnno]; !strings.HasPrefix(got, "Reported_") {
+				t.Errorf("handshake annotation = %s, want Reported_ prefix", got)
+			}
+			if ps.lastRegister != register || !ps.lastHandshake.Equal(now) {
+				t.Errorf("lastRegister = %s, lastHandshake = %v after patch", ps.lastRegister, ps.lastHandshake)
+			}
+
+			// 刚刚上报过，设备信息没有变化时不再更新节点
+			now = now.Add(time.Second)
+			if err := ps.registerHAMi(false); err != nil {
+				t.Fatalf("registerHAMi() error = %v", err)
+			}
+			if got := countPatches(client); got != 1 {
+				t.Errorf("registerHAMi() patched node %d times after an unchanged report, want 1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal/hami"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/klog/v2"
+)
+
+// allocateAbortTimeout 取消正在进行的Allocate之后，等待它们释放节点锁的时间
+const allocateAbortTimeout = 5 * time.Second
+
+// Shutdown 插件退出时调用，停止服务之后按照配置把注册到节点上的设备标记为不健康
+func (ps *PluginServer) Shutdown() error {
+	err := ps.Stop()
+	if ps.runtime.UnregisterOnShutdown {
+		if perr := ps.publishShutdown(); perr != nil {
+			klog.ErrorS(perr, "failed to mark devices as going away")
+		}
+	}
+	return err
+}
+
+func (ps *PluginServer) goLoop(loop func()) {
+	loops := ps.loops
+	loops.Add(1)
+	go func() {
+		defer loops.Done()
+		loop()
+	}()
+}
+
+// beginAllocate 记录一次正在进行的Allocate，drain开始之后返回false，调用方需要在结束时调用Done
+func (ps *PluginServer) beginAllocate() (*sync.WaitGroup, bool) {
+	ps.drainMu.Lock()
+	defer ps.drainMu.Unlock()
+	if ps.draining {
+		return nil, false
+	}
+	ps.allocating.Add(1)
+	return ps.allocating, true
+}
+
+// drain 不再接受新的请求，等待正在进行的Allocate完成。超过shutdownGracePeriod之后强制停止GRPC服务，
+// 此时Allocate的context被取消，Allocate按照分配失败释放节点锁之后返回
+func (ps *PluginServer) drain() {
+	ps.drainMu.Lock()
+	ps.draining = true
+	ps.drainMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		ps.grpcServer.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(ps.runtime.ShutdownGracePeriod.Duration):
+	}
+	klog.InfoS("in-flight Allocate calls did not finish in grace period, aborting them", "gracePeriod", ps.runtime.ShutdownGracePeriod.Duration)
+	ps.grpcServer.Stop()
+	if !waitTimeout(ps.allocating, allocateAbortTimeout) {
+		klog.ErrorS(nil, "aborted Allocate calls did not return, node lock may not be released", "timeout", allocateAbortTimeout)
+	}
+}
+
+// publishShutdown 把所有注册到节点上的设备标记为不健康，插件重新启动之后会重新注册
+func (ps *PluginServer) publishShutdown() error {
+	devs := ps.registerDevices()
+	for _, dev := range devs {
+		dev.Health = false
+	}
+	data, err := json.Marshal(devs)
+	if err != nil {
+		return fmt.Errorf("marshal register devices error: %v", err)
+	}
+	annos := map[string]string{ps.registerAnno: string(data)}
+	if ps.dryRun {
+		klog.InfoS("dry run: would mark devices as going away", "annotations", annos)
+		return nil
+	}
+	if err := hami.PatchNodeAnnotations(context.Background(), ps.client, ps.nodeName, annos); err != nil {
+		return err
+	}
+	klog.InfoS("marked devices as going away", "count", len(devs))
+	return nil
+}
+
+// waitTimeout 等待wg结束，超时返回false
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/hami"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/manager"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		name        string
+		gracePeriod time.Duration
+		releaseHold time.Duration // 正在进行的Allocate在开始drain之后多久可以继续
+		wantAborted bool
+	}{
+		{name: "in-flight Allocate finishes in grace period", gracePeriod: time.Minute, releaseHold: 100 * time.Millisecond},
+		{name: "in-flight Allocate aborted after grace period", gracePeriod: 50 * time.Millisecond, releaseHold: 300 * time.Millisecond, wantAborted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := lockedNode("infer-0")
+			client := fake.NewSimpleClientset(node, testPod("infer-0", hami.DeviceBindAllocating, `[{"UUID":"a"}]`))
+			// 让Allocate停在查询节点锁的位置，模拟正在进行的Allocate
+			entered, release := make(chan struct{}, 1), make(chan struct{})
+			client.PrependReactor("get", "nodes", func(k8stesting.Action) (bool, runtime.Object, error) {
+				select {
+				case entered <- struct{}{}:
+				default:
+				}
+				<-release
+				return false, nil, nil
+			})
+			ps := &PluginServer{
+				nodeName:  testNode,
+				allocAnno: "huawei.com/Ascend910B",
+				mgr:       &manager.AscendManager{},
+				client:    client,
+				runtime: internal.RuntimeConfig{
+					DialTimeout:         metav1.Duration{Duration: time.Second},
+					ShutdownGracePeriod: metav1.Duration{Duration: tt.gracePeriod},
+				},
+				socket:     filepath.Join(t.TempDir(), "test.sock"),
+				allocating: &sync.WaitGroup{},
+				now:        time.Now,
+			}
+			if err := ps.serve(); err != nil {
+				t.Fatalf("serve() error = %v", err)
+			}
+			conn, err := ps.dial(ps.socket, time.Second)
+			if err != nil {
+				t.Fatalf("dial() error = %v", err)
+			}
+			defer conn.Close()
+			go func() {
+				req := &v1beta1.AllocateRequest{ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIDs: []string{"a"}}}}
+				_, _ = v1beta1.NewDevicePluginClient(conn).Allocate(context.Background(), req)
+			}()
+			select {
+			case <-entered:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Allocate did not start")
+			}
+
+			drained := make(chan struct{})
+			start := time.Now()
+			go func() {
+				ps.drain()
+				close(drained)
+			}()
+			time.Sleep(tt.releaseHold)
+			select {
+			case <-drained:
+				t.Fatal("drain() returned while Allocate was in flight")
+			default:
+			}
+			close(release)
+			select {
+			case <-drained:
+			case <-time.After(allocateAbortTimeout + time.Second):
+				t.Fatal("drain() did not return")
+			}
+			if elapsed := time.Since(start); elapsed < tt.releaseHold {
+				t.Errorf("drain() returned after %v, before Allocate finished", elapsed)
+			}
+
+			records := ps.debug.recentAllocations()
+			if len(records) != 1 {
+				t.Fatalf("got %d allocation records, want 1", len(records))
+			}
+			if aborted := strings.Contains(records[0].Error, "aborted"); aborted != tt.wantAborted {
+				t.Errorf("allocation error = %q, want aborted %v", records[0].Error, tt.wantAborted)
+			}
+			if tt.wantAborted {
+				got, err := client.CoreV1().Nodes().Get(context.Background(), testNode, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if lock, ok := got.Annotations[hami.NodeLockKey]; ok {
+					t.Errorf("node lock %q not released after Allocate aborted", lock)
+				}
+			}
+
+			// drain开始之后不再接受新的Allocate
+			if _, err := ps.Allocate(context.Background(), &v1beta1.AllocateRequest{}); err == nil {
+				t.Errorf("Allocate() after drain succeeded, want error")
+			}
+			if got := len(ps.debug.recentAllocations()); got != 1 {
+				t.Errorf("got %d allocation records after drain, want 1", got)
+			}
+		})
+	}
+}
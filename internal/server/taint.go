@@ -0,0 +1,131 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+// updateTaint 根据不健康的卡的数量给当前节点打上或者移除污点，每次健康检查都会调用
+func (ps *PluginServer) updateTaint(unhealthy int) {
+	tc := ps.runtime.Taint
+	if !tc.Enabled {
+		return
+	}
+	if !ps.taintInitialized {
+		node, err := ps.cachedNode()
+		if err != nil {
+			klog.ErrorS(err, "failed to get node from cache")
+			return
+		}
+		ps.tainted = hasTaint(node, tc.Key, tc.Effect)
+		ps.taintInitialized = true
+	}
+	logger := klog.Background().WithValues("taint", tc.Key+":"+string(tc.Effect), "unhealthy", unhealthy)
+	switch {
+	case !ps.tainted && unhealthy >= tc.Threshold:
+		logger.Info("unhealthy devices reached threshold, tainting node", "threshold", tc.Threshold)
+		if err := ps.setTaint(true); err != nil {
+			logger.Error(err, "failed to taint node")
+			return
+		}
+		ps.tainted = true
+		ps.recoveredSince = time.Time{}
+		ps.recorder.Eventf(ps.nodeRef(), v1.EventTypeWarning, eventReasonUnhealthy,
+			"%d unhealthy %s devices, added taint %s:%s", unhealthy, ps.mgr.CommonWord(), tc.Key, tc.Effect)
+	case ps.tainted && unhealthy <= *tc.RecoverThreshold:
+		if ps.recoveredSince.IsZero() {
+			ps.recoveredSince = ps.now()
+		}
+		if ps.now().Sub(ps.recoveredSince) < tc.RecoverDelay.Duration {
+			return
+		}
+		logger.Info("unhealthy devices stayed at or below recover threshold, removing taint",
+			"recoverThreshold", *tc.RecoverThreshold, "recoverDelay", tc.RecoverDelay.Duration)
+		if err := ps.setTaint(false); err != nil {
+			logger.Error(err, "failed to remove taint")
+			return
+		}
+		ps.tainted = false
+		ps.recoveredSince = time.Time{}
+		ps.recorder.Eventf(ps.nodeRef(), v1.EventTypeNormal, eventReasonHealthy,
+			"%s devices recovered, removed taint %s:%s", ps.mgr.CommonWord(), tc.Key, tc.Effect)
+	case ps.tainted:
+		// 还没有恢复到recoverThreshold以下，重新开始计时
+		ps.recoveredSince = time.Time{}
+	}
+}
+
+func hasTaint(node *v1.Node, key string, effect v1.TaintEffect) bool {
+	for _, t := range node.Spec.Taints {
+		if t.Key == key && t.Effect == effect {
+			return true
+		}
+	}
+	return false
+}
+
+func (ps *PluginServer) setTaint(add bool) (err error) {
+	tc := ps.runtime.Taint
+	if ps.dryRun {
+		klog.InfoS("dry run: would set taint", "taint", tc.Key+":"+string(tc.Effect), "add", add)
+		return nil
+	}
+	ctx, span := tracing.Start(context.Background(), "setTaint", attribute.Bool("add", add))
+	defer func() { tracing.End(span, err) }()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		getCtx, getSpan := tracing.Start(ctx, "getNode")
+		node, err := ps.client.CoreV1().Nodes().Get(getCtx, ps.nodeName, metav1.GetOptions{})
+		tracing.End(getSpan, err)
+		if err != nil {
+			return err
+		}
+		if hasTaint(node, tc.Key, tc.Effect) == add {
+			return nil
+		}
+		newNode := node.DeepCopy()
+		if add {
+			now := metav1.NewTime(ps.now())
+			newNode.Spec.Taints = append(newNode.Spec.Taints, v1.Taint{
+				Key:       tc.Key,
+				Value:     ps.mgr.CommonWord(),
+				Effect:    tc.Effect,
+				TimeAdded: &now,
+			})
+		} else {
+			taints := make([]v1.Taint, 0, len(node.Spec.Taints))
+			for _, t := range node.Spec.Taints {
+				if t.Key != tc.Key || t.Effect != tc.Effect {
+					taints = append(taints, t)
+				}
+			}
+			newNode.Spec.Taints = taints
+		}
+		updateCtx, updateSpan := tracing.Start(ctx, "updateNode")
+		_, err = ps.client.CoreV1().Nodes().Update(updateCtx, newNode, metav1.UpdateOptions{})
+		tracing.End(updateSpan, err)
+		return err
+	})
+}
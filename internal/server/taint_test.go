@@ -0,0 +1,139 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/manager"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	listerv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestUpdateTaint(t *testing.T) {
+	type step struct {
+		after     time.Duration // 距离上一次健康检查的时间
+		unhealthy int
+		want      bool // 节点上是否有污点
+	}
+	recoverThreshold := 1
+	config := internal.TaintConfig{
+		Enabled:          true,
+		Threshold:        3,
+		RecoverThreshold: &recoverThreshold,
+		RecoverDelay:     metav1.Duration{Duration: 5 * time.Minute},
+	}
+	config.SetDefaults()
+	taint := v1.Taint{Key: config.Key, Effect: config.Effect}
+	tests := []struct {
+		name     string
+		disabled bool
+		tainted  bool // 插件启动时节点上已经有污点
+		steps    []step
+		events   int
+	}{
+		{
+			name:  "below threshold",
+			steps: []step{{0, 0, false}, {time.Second, 2, false}, {time.Second, 1, false}},
+		},
+		{
+			name:   "tainted at threshold",
+			steps:  []step{{0, 2, false}, {time.Second, 3, true}, {time.Second, 4, true}},
+			events: 1,
+		},
+		{
+			name: "stays tainted between recover threshold and threshold",
+			steps: []step{
+				{0, 3, true}, {time.Second, 2, true}, {10 * time.Minute, 2, true},
+			},
+			events: 1,
+		},
+		{
+			name: "removed after recover delay",
+			steps: []step{
+				{0, 3, true}, {time.Second, 1, true}, {5*time.Minute - time.Second, 0, true}, {time.Second, 1, false},
+			},
+			events: 2,
+		},
+		{
+			name: "recover delay restarts when devices become unhealthy again",
+			steps: []step{
+				{0, 3, true}, {time.Second, 1, true}, {4 * time.Minute, 2, true},
+				{time.Minute, 1, true}, {5*time.Minute - time.Second, 1, true}, {time.Second, 1, false},
+			},
+			events: 2,
+		},
+		{
+			name:    "existing taint is kept until recovered",
+			tainted: true,
+			steps:   []step{{0, 2, true}, {time.Second, 0, true}, {5 * time.Minute, 0, false}},
+			events:  1,
+		},
+		{
+			name:     "disabled",
+			disabled: true,
+			steps:    []step{{0, 8, false}, {time.Second, 8, false}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2024, 7, 10, 0, 0, 0, 0, time.UTC)
+			node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNode}}
+			if tt.tainted {
+				node.Spec.Taints = []v1.Taint{taint}
+			}
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			if err := indexer.Add(node); err != nil {
+				t.Fatal(err)
+			}
+			client := fake.NewSimpleClientset(node)
+			recorder := record.NewFakeRecorder(10)
+			tc := config
+			tc.Enabled = !tt.disabled
+			ps := &PluginServer{
+				nodeName:   testNode,
+				mgr:        &manager.AscendManager{},
+				client:     client,
+				runtime:    internal.RuntimeConfig{Taint: tc},
+				nodeLister: listerv1.NewNodeLister(indexer),
+				recorder:   recorder,
+				now:        func() time.Time { return now },
+			}
+			for i, s := range tt.steps {
+				now = now.Add(s.after)
+				ps.updateTaint(s.unhealthy)
+				got, err := client.CoreV1().Nodes().Get(context.Background(), testNode, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tainted := hasTaint(got, tc.Key, tc.Effect); tainted != s.want {
+					t.Fatalf("step %d: updateTaint(%d) tainted = %v, want %v", i, s.unhealthy, tainted, s.want)
+				}
+			}
+			if got := len(recorder.Events); got != tt.events {
+				t.Errorf("recorded %d events, want %d", got, tt.events)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal/manager"
+	"github.com/Project-HAMi/ascend-device-plugin/internal/metrics"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// EnableTelemetry 开启硬件遥测数据的定期采集，需要在Start之前调用
+func (ps *PluginServer) EnableTelemetry() {
+	ps.telemetry = true
+}
+
+// watchTelemetry 定期采集每张卡的硬件遥测数据，并按照卡上的Pod更新Prometheus指标
+func (ps *PluginServer) watchTelemetry() {
+	// 上一次采集时每张卡上的Pod，Pod发生变化时需要删除旧的时间序列
+	lastPods := make(map[string]string)
+	ticker := time.NewTicker(ps.runtime.TelemetryInterval.Duration)
+	defer ticker.Stop()
+	for {
+		ps.collectTelemetry(lastPods)
+		select {
+		case <-ps.stopCh:
+			klog.InfoS("stop watch telemetry")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ps *PluginServer) collectTelemetry(lastPods map[string]string) {
+	pods := ps.devicePods()
+	seen := make(map[string]bool)
+	for _, dev := range ps.mgr.GetDevices() {
+		seen[dev.UUID] = true
+		key := fmt.Sprint(pods[dev.UUID])
+		if last, ok := lastPods[dev.UUID]; ok && last != key {
+			metrics.DeleteDeviceTelemetry(dev.UUID)
+		}
+		lastPods[dev.UUID] = key
+		setTelemetry(dev, pods[dev.UUID], ps.mgr.Telemetry(dev.LogicID))
+	}
+	for uuid := range lastPods {
+		if !seen[uuid] {
+			metrics.DeleteDeviceTelemetry(uuid)
+			delete(lastPods, uuid)
+		}
+	}
+}
+
+func setTelemetry(dev *manager.Device, pods []types.NamespacedName, t manager.Telemetry) {
+	if len(pods) == 0 {
+		pods = []types.NamespacedName{{}}
+	}
+	phyID := fmt.Sprint(dev.PhyID)
+	for _, pod := range pods {
+		lv := []string{dev.UUID, phyID, pod.Namespace, pod.Name}
+		if t.Temperature != nil {
+			metrics.DeviceTemperature.WithLabelValues(lv...).Set(float64(*t.Temperature))
+		}
+		if t.Power != nil {
+			metrics.DevicePower.WithLabelValues(lv...).Set(float64(*t.Power))
+		}
+		if t.AICoreUtilization != nil {
+			metrics.DeviceAICoreUtilization.WithLabelValues(lv...).Set(float64(*t.AICoreUtilization))
+		}
+		if t.HBMTotal != nil {
+			metrics.DeviceHBMTotal.WithLabelValues(lv...).Set(float64(*t.HBMTotal) * 1024 * 1024)
+		}
+		if t.HBMUsed != nil {
+			metrics.DeviceHBMUsed.WithLabelValues(lv...).Set(float64(*t.HBMUsed) * 1024 * 1024)
+		}
+		if t.ECCSingleBitErrors != nil {
+			metrics.DeviceECCErrors.WithLabelValues(append(lv, "single_bit")...).Set(float64(*t.ECCSingleBitErrors))
+		}
+		if t.ECCDoubleBitErrors != nil {
+			metrics.DeviceECCErrors.WithLabelValues(append(lv, "double_bit")...).Set(float64(*t.ECCDoubleBitErrors))
+		}
+	}
+}
+
+// devicePods 每张卡上已经分配了设备并且还没有结束的Pod
+func (ps *PluginServer) devicePods() map[string][]types.NamespacedName {
+	result := make(map[string][]types.NamespacedName)
+	for _, d := range ps.containers.list() {
+		name := types.NamespacedName{Namespace: d.Namespace, Name: d.Pod}
+		if !slices.Contains(result[d.UUID], name) {
+			result[d.UUID] = append(result[d.UUID], name)
+		}
+	}
+	return result
+}
@@ -0,0 +1,255 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package simulator 在没有昇腾硬件的情况下模拟一个节点上的vNPU分配，用于修改模板或者memoryAllocatable之前评估容量
+package simulator
+
+import (
+	"fmt"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal"
+)
+
+const (
+	// PolicySpread 优先分配到使用量最少的卡上，HAMi调度器默认的设备调度策略
+	PolicySpread = "spread"
+	// PolicyBinpack 优先分配到使用量最多的卡上
+	PolicyBinpack = "binpack"
+)
+
+/* 模拟场景如下
+chip: 910B3
+cards: 8
+# 不健康的卡的序号，不会分配
+unhealthy: [3]
+# 用于匹配配置文件中的nodeOverrides
+nodeLabels:
+  pool: inference
+requests:
+- name: infer-small
+  count: 1
+  memory: 8192
+  replicas: 10
+- name: train
+  count: 4
+*/
+
+// Scenario 模拟的节点以及依次到达的申请
+type Scenario struct {
+	Chip       string            `json:"chip"`
+	Cards      int               `json:"cards"`
+	Unhealthy  []int             `json:"unhealthy,omitempty"`
+	NodeLabels map[string]string `json:"nodeLabels,omitempty"`
+	Requests   []Request         `json:"requests"`
+}
+
+// Request 一个容器的申请，count对应resourceName，memory对应resourceMemoryName，不设置memory时申请整卡
+type Request struct {
+	Name     string `json:"name"`
+	Count    int    `json:"count"`
+	Memory   int64  `json:"memory,omitempty"`
+	Replicas int    `json:"replicas,omitempty"`
+}
+
+// Card 模拟结束之后一张卡的使用情况
+type Card struct {
+	Index      int   `json:"index"`
+	Healthy    bool  `json:"healthy"`
+	VNPUs      int   `json:"vnpus"`
+	MaxVNPUs   int   `json:"maxVNPUs"`
+	UsedMemory int64 `json:"usedMemory"`
+	Memory     int64 `json:"memory"`
+	UsedAICore int32 `json:"usedAICore"`
+	AICore     int32 `json:"aiCore"`
+	// 不健康的卡没有剩余资源
+	LeftoverMemory int64 `json:"leftoverMemory"`
+	LeftoverVNPUs  int   `json:"leftoverVNPUs"`
+}
+
+// Allocation 一个申请的分配结果，Reason不为空时表示被拒绝
+type Allocation struct {
+	Request  string `json:"request"`
+	Count    int    `json:"count"`
+	Memory   int64  `json:"memory,omitempty"`
+	Template string `json:"template,omitempty"`
+	Granted  int64  `json:"grantedMemory,omitempty"`
+	Cards    []int  `json:"cards,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type Result struct {
+	Allocations []Allocation `json:"allocations"`
+	Cards       []Card       `json:"cards"`
+	Placed      int          `json:"placed"`
+	Rejected    int          `json:"rejected"`
+}
+
+// Run 按照申请的顺序依次分配，使用和AscendManager相同的VDeviceCount以及和HAMi调度器相同的模板选择逻辑
+func Run(vc *internal.VNPUConfig, scenario *Scenario, policy string) (*Result, error) {
+	if scenario.Cards <= 0 {
+		return nil, fmt.Errorf("cards must be positive")
+	}
+	if policy != PolicySpread && policy != PolicyBinpack {
+		return nil, fmt.Errorf("unknown policy %s, expected %s or %s", policy, PolicySpread, PolicyBinpack)
+	}
+	maxVNPUs := vc.VDeviceCount()
+	cards := make([]*Card, scenario.Cards)
+	for i := range cards {
+		cards[i] = &Card{Index: i, Healthy: true, MaxVNPUs: maxVNPUs, Memory: vc.MemoryAllocatable, AICore: vc.AICore}
+	}
+	for _, i := range scenario.Unhealthy {
+		if i < 0 || i >= len(cards) {
+			return nil, fmt.Errorf("unhealthy card %d out of range [0, %d)", i, len(cards))
+		}
+		cards[i].Healthy = false
+	}
+
+	result := &Result{}
+	for _, req := range scenario.Requests {
+		replicas := req.Replicas
+		if replicas <= 0 {
+			replicas = 1
+		}
+		for r := 0; r < replicas; r++ {
+			name := req.Name
+			if replicas > 1 {
+				name = fmt.Sprintf("%s#%d", req.Name, r)
+			}
+			alloc := allocate(vc, cards, req, policy)
+			alloc.Request = name
+			if alloc.Reason != "" {
+				result.Rejected++
+			} else {
+				result.Placed++
+			}
+			result.Allocations = append(result.Allocations, alloc)
+		}
+	}
+	for _, c := range cards {
+		if c.Healthy {
+			c.LeftoverMemory = c.Memory - c.UsedMemory
+			c.LeftoverVNPUs = leftoverVNPUs(vc, c)
+		}
+		result.Cards = append(result.Cards, *c)
+	}
+	return result, nil
+}
+
+func allocate(vc *internal.VNPUConfig, cards []*Card, req Request, policy string) Allocation {
+	alloc := Allocation{Count: req.Count, Memory: req.Memory}
+	if req.Count <= 0 {
+		alloc.Reason = "count must be positive"
+		return alloc
+	}
+	// 不设置显存时申请整卡
+	memory, template := vc.MemoryAllocatable, ""
+	if req.Memory > 0 {
+		memory, template = vc.TrimMemory(req.Memory)
+		if memory == 0 {
+			alloc.Reason = fmt.Sprintf("memory %d exceeds memoryCapacity %d", req.Memory, vc.MemoryCapacity)
+			return alloc
+		}
+	}
+	alloc.Template, alloc.Granted = template, memory
+	// 昇腾只支持在单卡上使用模板
+	if template != "" && req.Count > 1 {
+		alloc.Reason = "vNPU templates only support single card requests"
+		return alloc
+	}
+	aiCore := vc.AICore
+	if template != "" {
+		aiCore = templateAICore(vc, template)
+	}
+	var candidates []*Card
+	for _, c := range cards {
+		if fits(c, template, memory, aiCore) {
+			candidates = append(candidates, c)
+		}
+	}
+	if len(candidates) < req.Count {
+		alloc.Reason = fmt.Sprintf("%d of %d cards available", len(candidates), req.Count)
+		return alloc
+	}
+	for i := 0; i < req.Count; i++ {
+		best := pick(candidates, policy)
+		c := candidates[best]
+		candidates = append(candidates[:best], candidates[best+1:]...)
+		if template == "" {
+			// 整卡独占
+			c.VNPUs, c.UsedMemory, c.UsedAICore = c.MaxVNPUs, c.Memory, c.AICore
+		} else {
+			c.VNPUs++
+			c.UsedMemory += memory
+			c.UsedAICore += aiCore
+		}
+		alloc.Cards = append(alloc.Cards, c.Index)
+	}
+	return alloc
+}
+
+func fits(c *Card, template string, memory int64, aiCore int32) bool {
+	if !c.Healthy {
+		return false
+	}
+	if template == "" {
+		return c.VNPUs == 0
+	}
+	return c.VNPUs < c.MaxVNPUs && c.UsedMemory+memory <= c.Memory && coreFits(c, c.UsedAICore+aiCore)
+}
+
+// coreFits 配置中没有设置aiCore时不检查AICore
+func coreFits(c *Card, aiCore int32) bool {
+	return c.AICore == 0 || aiCore <= c.AICore
+}
+
+// pick spread选择剩余显存最多的卡，binpack选择剩余显存最少的卡，相同时选择序号小的卡
+func pick(cards []*Card, policy string) int {
+	best := 0
+	for i := 1; i < len(cards); i++ {
+		if policy == PolicySpread && cards[i].UsedMemory < cards[best].UsedMemory ||
+			policy == PolicyBinpack && cards[i].UsedMemory > cards[best].UsedMemory {
+			best = i
+		}
+	}
+	return best
+}
+
+func templateAICore(vc *internal.VNPUConfig, template string) int32 {
+	for _, t := range vc.Templates {
+		if t.Name == template {
+			return t.AICore
+		}
+	}
+	return 0
+}
+
+// leftoverVNPUs 卡上剩余的资源还可以创建多少个最小模板的vNPU
+func leftoverVNPUs(vc *internal.VNPUConfig, c *Card) int {
+	if len(vc.Templates) == 0 {
+		if c.VNPUs == 0 {
+			return 1
+		}
+		return 0
+	}
+	smallest := vc.Templates[0]
+	n := 0
+	for used, mem, core := c.VNPUs, c.UsedMemory, c.UsedAICore; used < c.MaxVNPUs && mem+smallest.Memory <= c.Memory && coreFits(c, core+smallest.AICore); n++ {
+		used++
+		mem += smallest.Memory
+		core += smallest.AICore
+	}
+	return n
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright 2024 The HAMi Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package simulator
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Project-HAMi/ascend-device-plugin/internal"
+)
+
+func testVNPUConfig() *internal.VNPUConfig {
+	return &internal.VNPUConfig{
+		ChipName:          "910B3",
+		MemoryAllocatable: 65536,
+		MemoryCapacity:    65536,
+		AICore:            20,
+		AICPU:             7,
+		Templates: []internal.Template{
+			{Name: "vir05_1c_16g", Memory: 16384, AICore: 5, AICPU: 1},
+			{Name: "vir10_3c_32g", Memory: 32768, AICore: 10, AICPU: 3},
+		},
+	}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		cards     int
+		unhealthy []int
+		requests  []Request
+		// 每个申请分配到的卡，被拒绝的申请为nil
+		wantCards    [][]int
+		wantLeftover []int
+		wantMemory   []int64
+	}{
+		{
+			name:         "spread over cards",
+			policy:       PolicySpread,
+			cards:        2,
+			requests:     []Request{{Name: "small", Count: 1, Memory: 8192, Replicas: 2}},
+			wantCards:    [][]int{{0}, {1}},
+			wantLeftover: []int{3, 3},
+			wantMemory:   []int64{49152, 49152},
+		},
+		{
+			name:         "binpack onto one card",
+			policy:       PolicyBinpack,
+			cards:        2,
+			requests:     []Request{{Name: "small", Count: 1, Memory: 8192, Replicas: 2}},
+			wantCards:    [][]int{{0}, {0}},
+			wantLeftover: []int{2, 4},
+			wantMemory:   []int64{32768, 65536},
+		},
+		{
+			name:   "mixed templates",
+			policy: PolicyBinpack,
+			cards:  1,
+			requests: []Request{
+				{Name: "large", Count: 1, Memory: 20000},
+				{Name: "small", Count: 1, Memory: 16384},
+			},
+			wantCards:    [][]int{{0}, {0}},
+			wantLeftover: []int{1},
+			wantMemory:   []int64{16384},
+		},
+		{
+			name:   "template does not fit",
+			policy: PolicySpread,
+			cards:  1,
+			requests: []Request{
+				{Name: "large", Count: 1, Memory: 32768, Replicas: 2},
+				{Name: "small", Count: 1, Memory: 1024},
+			},
+			wantCards:    [][]int{{0}, {0}, nil},
+			wantLeftover: []int{0},
+			wantMemory:   []int64{0},
+		},
+		{
+			name:      "unhealthy card has no leftover",
+			policy:    PolicySpread,
+			cards:     2,
+			unhealthy: []int{0},
+			requests: []Request{
+				{Name: "whole", Count: 1},
+				{Name: "small", Count: 1, Memory: 8192},
+			},
+			wantCards:    [][]int{{1}, nil},
+			wantLeftover: []int{0, 0},
+			wantMemory:   []int64{0, 0},
+		},
+		{
+			name:   "whole cards",
+			policy: PolicySpread,
+			cards:  3,
+			requests: []Request{
+				{Name: "train", Count: 2},
+				{Name: "train", Count: 2},
+			},
+			wantCards:    [][]int{{0, 1}, nil},
+			wantLeftover: []int{0, 0, 4},
+			wantMemory:   []int64{0, 0, 65536},
+		},
+		{
+			name:   "rejected requests",
+			policy: PolicySpread,
+			cards:  2,
+			requests: []Request{
+				{Name: "multi-card template", Count: 2, Memory: 8192},
+				{Name: "too large", Count: 1, Memory: 131072},
+				{Name: "no count", Count: 0},
+			},
+			wantCards:    [][]int{nil, nil, nil},
+			wantLeftover: []int{4, 4},
+			wantMemory:   []int64{65536, 65536},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scenario := &Scenario{Chip: "910B3", Cards: tt.cards, Unhealthy: tt.unhealthy, Requests: tt.requests}
+			result, err := Run(testVNPUConfig(), scenario, tt.policy)
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			var gotCards [][]int
+			placed := 0
+			for _, alloc := range result.Allocations {
+				gotCards = append(gotCards, alloc.Cards)
+				if alloc.Reason == "" {
+					placed++
+				}
+			}
+			if !reflect.DeepEqual(gotCards, tt.wantCards) {
+				t.Errorf("Run() cards = %v, want %v", gotCards, tt.wantCards)
+			}
+			if result.Placed != placed || result.Rejected != len(result.Allocations)-placed {
+				t.Errorf("Run() placed %d rejected %d, want %d and %d", result.Placed, result.Rejected, placed, len(result.Allocations)-placed)
+			}
+			var leftover []int
+			var memory []int64
+			for _, c := range result.Cards {
+				leftover = append(leftover, c.LeftoverVNPUs)
+				memory = append(memory, c.LeftoverMemory)
+			}
+			if !reflect.DeepEqual(leftover, tt.wantLeftover) {
+				t.Errorf("Run() leftover vNPUs = %v, want %v", leftover, tt.wantLeftover)
+			}
+			if !reflect.DeepEqual(memory, tt.wantMemory) {
+				t.Errorf("Run() leftover memory = %v, want %v", memory, tt.wantMemory)
+			}
+		})
+	}
+}
+
+func TestRunInvalidScenario(t *testing.T) {
+	tests := []struct {
+		name     string
+		scenario Scenario
+		policy   string
+	}{
+		{"no cards", Scenario{Cards: 0}, PolicySpread},
+		{"unknown policy", Scenario{Cards: 1}, "random"},
+		{"unhealthy card out of range", Scenario{Cards: 2, Unhealthy: []int{2}}, PolicySpread},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Run(testVNPUConfig(), &tt.scenario, tt.policy); err == nil {
+				t.Errorf("Run() should fail")
+			}
+		})
+	}
+}
@@ -17,7 +17,10 @@ limitations under the License.
 package internal
 
 import (
+	"fmt"
 	"os"
+	"sort"
+	"strings"
 
 	"k8s.io/apimachinery/pkg/util/yaml"
 )
@@ -185,18 +188,164 @@ type VNPUConfig struct {
 }
 
 type Config struct {
-	VNPUs []VNPUConfig `json:"vnpus"`
+	// 配置的版本，见schema.go
+	APIVersion string        `json:"apiVersion,omitempty"`
+	Kind       string        `json:"kind,omitempty"`
+	VNPUs      []VNPUConfig  `json:"vnpus"`
+	Runtime    RuntimeConfig `json:"runtime,omitempty"`
+	// 停止对外提供服务的卡，可以是UUID或者物理ID。物理ID对所有节点生效，只想停用某一个节点上的卡时使用节点注解
+	DisabledDevices []string `json:"disabledDevices,omitempty"`
+	// 按照节点标签覆盖部分节点的vnpu配置
+	NodeOverrides []NodeOverride `json:"nodeOverrides,omitempty"`
 }
 
+// Validate 校验芯片配置是否合法
+func (vc *VNPUConfig) Validate() error {
+	if vc.CommonWord == "" || vc.ResourceName == "" {
+		return fmt.Errorf("chip %s: commonWord and resourceName must be set", vc.ChipName)
+	}
+	if vc.MemoryAllocatable <= 0 || vc.MemoryAllocatable > vc.MemoryCapacity {
+		return fmt.Errorf("chip %s: memoryAllocatable %d must be positive and not larger than memoryCapacity %d",
+			vc.ChipName, vc.MemoryAllocatable, vc.MemoryCapacity)
+	}
+	names := make(map[string]bool, len(vc.Templates))
+	for _, t := range vc.Templates {
+		if t.Name == "" || names[t.Name] {
+			return fmt.Errorf("chip %s: template name %q is empty or duplicated", vc.ChipName, t.Name)
+		}
+		names[t.Name] = true
+		if t.Memory <= 0 || t.Memory > vc.MemoryAllocatable {
+			return fmt.Errorf("chip %s: memory %d of template %s must be positive and not larger than memoryAllocatable %d",
+				vc.ChipName, t.Memory, t.Name, vc.MemoryAllocatable)
+		}
+	}
+	return nil
+}
+
+// VDeviceCount 每张卡上报给kubelet的虚拟设备数量
+func (vc *VNPUConfig) VDeviceCount() int {
+	if len(vc.Templates) == 0 {
+		return 1
+	}
+	// 昇腾的算力切分，本质上就是应用昇腾的模板，因此这里最多可以创建的虚卡数量为可分配内存处于最小模板需要使用的内存大小
+	return int(vc.MemoryAllocatable / vc.Templates[0].Memory)
+}
+
+// TrimMemory 找到能满足申请显存的最小模板，返回模板的显存和模板名，与HAMi调度器中的逻辑一致。
+// 没有合适的模板但是不超过卡的显存时使用整卡，模板名为空；超过卡的显存时返回0
+func (vc *VNPUConfig) TrimMemory(m int64) (int64, string) {
+	for i := 0; i < len(vc.Templates); i++ {
+		if m <= vc.Templates[i].Memory {
+			return vc.Templates[i].Memory, vc.Templates[i].Name
+		}
+	}
+	if m <= vc.MemoryCapacity {
+		return vc.MemoryAllocatable, ""
+	}
+	return 0, ""
+}
+
+// SelectVNPUConfig 选择芯片对应的配置，合并节点匹配上的覆盖配置并校验，模板按照显存从小到大排序。返回生效的配置以及匹配上的覆盖配置名
+func (c *Config) SelectVNPUConfig(chipName string, nodeLabels map[string]string) (*VNPUConfig, []string, error) {
+	vc, overrides, err := c.EffectiveVNPUConfig(chipName, nodeLabels)
+	if err != nil {
+		return nil, nil, err
+	}
+	vc.SetDefaults()
+	if err := vc.Validate(); err != nil {
+		return nil, nil, err
+	}
+	// 显存按照从小到大排序，方便后续找到合适的显存模板
+	// hami的算力切分，本质上就是通过昇腾模板来进行切分的，类似于英伟达的MIG
+	sort.Slice(vc.Templates, func(i, j int) bool {
+		return vc.Templates[i].Memory < vc.Templates[j].Memory
+	})
+	return vc, overrides, nil
+}
+
+// ConfigMapKeys 配置文件是ConfigMap时，依次尝试从这些key中读取配置
+var ConfigMapKeys = []string{"ascend-config.yaml", "ascend-config.yml", "ascend-config.json"}
+
+// LoadConfig 读取配置文件，配置文件可以是只包含vnpus等字段的配置，也可以是完整的ConfigMap，YAML和JSON格式都支持
 func LoadConfig(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	var yamlData Config
-	err = yaml.Unmarshal(data, &yamlData)
+	config, err := ParseConfig(data)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// ParseConfig 解析配置内容，根据内容的结构判断是ConfigMap、带版本的配置还是旧格式的配置
+func ParseConfig(data []byte) (*Config, error) {
+	var obj map[string]interface{}
+	if err := yaml.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("invalid yaml or json: %w", err)
+	}
+	kind, ok := obj["kind"].(string)
+	if _, exist := obj["kind"]; exist && !ok {
+		return nil, fmt.Errorf("invalid kind %v", obj["kind"])
+	}
+	switch kind {
+	case "ConfigMap":
+		var cm struct {
+			Data map[string]string `json:"data"`
+		}
+		if err := yaml.Unmarshal(data, &cm); err != nil {
+			return nil, fmt.Errorf("invalid ConfigMap: %w", err)
+		}
+		return ParseConfigMapData(cm.Data)
+	case ConfigKind:
+		if _, ok := obj["apiVersion"].(string); !ok {
+			return nil, fmt.Errorf("kind %s requires apiVersion, supported versions are %s",
+				ConfigKind, strings.Join(SupportedConfigVersions(), ", "))
+		}
+		return decodeConfig(obj)
+	case "":
+		if _, ok := obj["vnpus"]; !ok {
+			keys := make([]string, 0, len(obj))
+			for k := range obj {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			return nil, fmt.Errorf("unrecognized config, expected kind %s, a document with a top-level vnpus field or a ConfigMap manifest, got fields %v", ConfigKind, keys)
+		}
+		if v, ok := obj["apiVersion"]; ok {
+			return nil, fmt.Errorf("apiVersion %v set without kind %s", v, ConfigKind)
+		}
+		return decodeConfig(obj)
+	default:
+		return nil, fmt.Errorf("unsupported kind %s, expected %s or ConfigMap", kind, ConfigKind)
+	}
+}
+
+// ParseConfigMapData 从ConfigMap的data中取出配置，优先使用ConfigMapKeys中的key，只有一个key时直接使用这个key
+func ParseConfigMapData(data map[string]string) (*Config, error) {
+	for _, key := range ConfigMapKeys {
+		if v, ok := data[key]; ok {
+			return parseConfigMapKey(key, v)
+		}
+	}
+	if len(data) == 1 {
+		for key, v := range data {
+			return parseConfigMapKey(key, v)
+		}
+	}
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return nil, fmt.Errorf("ConfigMap has no config key, expected one of %v, got keys %v", ConfigMapKeys, keys)
+}
+
+func parseConfigMapKey(key, value string) (*Config, error) {
+	config, err := ParseConfig([]byte(value))
+	if err != nil {
+		return nil, fmt.Errorf("ConfigMap key %s: %w", key, err)
 	}
-	return &yamlData, nil
+	return config, nil
 }
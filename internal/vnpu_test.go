@@ -0,0 +1,155 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		wantChips []string
+		wantErr   string
+	}{
+		{
+			name: "configmap manifest",
+			data: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: hami-scheduler-device
+data:
+  ascend-config.yaml: |-
+    vnpus:
+    - chipName: 910B3
+      commonWord: Ascend910B
+      memoryAllocatable: 65536
+`,
+			wantChips: []string{"910B3"},
+		},
+		{
+			name: "v1 document",
+			data: `
+apiVersion: ascend.hami.io/v1
+kind: AscendDeviceConfig
+vnpus:
+- chipName: 910B3
+  commonWord: Ascend910B
+- chipName: 910B4
+  commonWord: Ascend910B4
+nodeOverrides:
+- name: reserve-memory
+  nodeSelector:
+    matchLabels:
+      pool: inference
+  vnpus:
+  - chipName: 910B3
+    memoryAllocatable: 61440
+`,
+			wantChips: []string{"910B3", "910B4"},
+		},
+		{
+			name: "legacy document ignores fields of other vendors",
+			data: `
+nvidia:
+  resourceCountName: nvidia.com/gpu
+vnpus:
+- chipName: 910B3
+  commonWord: Ascend910B
+  memoryAllocatble: 65536
+`,
+			wantChips: []string{"910B3"},
+		},
+		{
+			name: "typo in v1 document",
+			data: `
+apiVersion: ascend.hami.io/v1
+kind: AscendDeviceConfig
+vnpus:
+- chipName: 910B3
+  memoryAllocatble: 65536
+`,
+			wantErr: `unknown field "vnpus[0].memoryAllocatble"`,
+		},
+		{
+			name: "typo in override of v1 document",
+			data: `
+apiVersion: ascend.hami.io/v1
+kind: AscendDeviceConfig
+vnpus:
+- chipName: 910B3
+nodeOverrides:
+- name: reserve-memory
+  nodeSelector:
+    matchLabels:
+      pool: inference
+  vnpus:
+  - chipName: 910B3
+    templates:
+    - name: vir05_1c_16g
+      memroy: 16384
+`,
+			wantErr: "vnpus[0] of override reserve-memory",
+		},
+		{
+			name: "apiVersion without kind",
+			data: `
+apiVersion: ascend.hami.io/v1
+vnpus:
+- chipName: 910B3
+`,
+			wantErr: "set without kind",
+		},
+		{
+			name: "unsupported apiVersion",
+			data: `
+apiVersion: ascend.hami.io/v2
+kind: AscendDeviceConfig
+vnpus:
+- chipName: 910B3
+`,
+			wantErr: `unsupported apiVersion "ascend.hami.io/v2"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := ParseConfig([]byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseConfig() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseConfig() error = %v", err)
+			}
+			if config.APIVersion != ConfigAPIVersion || config.Kind != ConfigKind {
+				t.Errorf("ParseConfig() converted to %s/%s, want %s/%s", config.APIVersion, config.Kind, ConfigAPIVersion, ConfigKind)
+			}
+			var chips []string
+			for _, vc := range config.VNPUs {
+				chips = append(chips, vc.ChipName)
+			}
+			if strings.Join(chips, ",") != strings.Join(tt.wantChips, ",") {
+				t.Errorf("ParseConfig() chips = %v, want %v", chips, tt.wantChips)
+			}
+		})
+	}
+}